@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// testWeaveDir is where weaver test looks for weaves by default, the go command ignores testdata directories
+const testWeaveDir = "testdata/weaves"
+
+// weaverTest weaves o into forks in a temporary directory, runs go test args against them and returns its exit code.
+// Test weaves only ever go into throw away forks, the production go.mod, forks and lock file are left alone. The
+// temporary directory is removed whatever the outcome.
+func weaverTest(o options, args []string) int {
+	tmp, err := ioutil.TempDir("", "weaver-test")
+	if err != nil {
+		log.Errorf("weaverTest: error creating temporary directory err: %+v", err)
+		return 1
+	}
+	defer removeTemp(tmp)
+	// Weaving exits on fatal errors, the directory goes then too
+	log.RegisterExitHandler(func() { removeTemp(tmp) })
+
+	o.writeDir = tmp + string(filepath.Separator)
+	o.stdDir = filepath.Join(tmp, "std")
+	o.proxyDir = ""
+	if o.lockFile == "" {
+		o.lockFile = filepath.Join(tmp, "weaver.lock")
+	}
+	if o.goMod, err = testGoMod(tmp); err != nil {
+		log.Errorf("weaverTest: %+v", err)
+		return 1
+	}
+	// The packages are loaded through the copy as well, the forks the production go.mod replaces modules with are
+	// never woven again
+	if err := os.Setenv("GOFLAGS", strings.TrimSpace(os.Getenv("GOFLAGS")+" -modfile="+o.goMod)); err != nil {
+		log.Errorf("weaverTest: error setting GOFLAGS err: %+v", err)
+		return 1
+	}
+	overlay, err := weaveRun(o)
+	if err != nil {
+		log.Errorf("weaver: %+v", err)
+		return 1
+	}
+	return goTest(o.goMod, overlay, args)
+}
+
+// removeTemp removes the temporary directory of weaver test
+func removeTemp(tmp string) {
+	if err := os.RemoveAll(tmp); err != nil {
+		log.Warnf("weaver: error removing temporary directory: %s err: %+v", tmp, err)
+	}
+}
+
+// testGoMod copies the main module's go.mod and go.sum to dir, the forks are added to the copy which go test is then
+// pointed at with -modfile
+func testGoMod(dir string) (string, error) {
+	for _, fn := range []string{"go.mod", "go.sum"} {
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			if fn == "go.sum" && os.IsNotExist(err) {
+				continue
+			}
+			return "", fmt.Errorf("testGoMod: error reading: %s err: %+v", fn, err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, fn), b, 0644); err != nil {
+			return "", fmt.Errorf("testGoMod: error writing: %s err: %+v", filepath.Join(dir, fn), err)
+		}
+	}
+	return filepath.Join(dir, "go.mod"), nil
+}
+
+// goTest runs go test with args against the go.mod file modFile, and the overlay of woven standard library files if
+// there is one, and returns its exit code
+func goTest(modFile string, overlay string, args []string) int {
+	flags := []string{"test", "-modfile=" + modFile}
+	if overlay != "" {
+		flags = append(flags, "-overlay="+overlay)
+	}
+	cmd := exec.Command("go", append(flags, args...)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	log.Debugf("goTest: cmd: %s", cmd.String())
+	if err := cmd.Run(); err != nil {
+		if exit, ok := err.(*exec.ExitError); ok {
+			return exit.ExitCode()
+		}
+		log.Errorf("goTest: error running go test err: %+v", err)
+		return 1
+	}
+	return 0
+}
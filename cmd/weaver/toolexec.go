@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gweaver/pkg"
+	"gweaver/weave"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// isTool reports whether arg is a go tool, go build -toolexec=weaver runs weaver with the tool's path first
+func isTool(arg string) bool {
+	return filepath.IsAbs(arg) && strings.Contains(filepath.ToSlash(arg), "/pkg/tool/")
+}
+
+// toolexec weaves packages as they are compiled, used as go build -toolexec=weaver or
+// go build -toolexec="weaver toolexec -weaveDir /abs/ext". Tools run in the directory of the package being built so
+// the weave directory should be absolute, GWEAVER_WEAVEDIR sets it without the toolexec sub-command.
+func toolexec(args []string) int {
+	weaveDir := os.Getenv("GWEAVER_WEAVEDIR")
+	if weaveDir == "" {
+		weaveDir = "ext"
+	}
+	fs := flag.NewFlagSet("toolexec", flag.ExitOnError)
+	fs.StringVar(&weaveDir, "weaveDir", weaveDir, "absolute directory holding the weaves, defaults to $GWEAVER_WEAVEDIR")
+	lockFile := fs.String("lock", "", "lock file pinning the originals of woven declarations, defaults to weaver.lock in weaveDir")
+	drift := fs.String("drift", weave.DriftFail, "what to do when a pinned original changed upstream: fail or warn")
+	logLevel := fs.String("logLevel", "warn", "log level: trace, debug, info, warn, error")
+	fs.BoolVar(&pkg.TrimPath, "trimpath", false, "name the files of //line directives relative like go build -trimpath")
+	if args[0] == "toolexec" {
+		fs.Parse(args[1:])
+		args = fs.Args()
+	}
+	if len(args) == 0 {
+		log.Fatalf("toolexec: no tool to run")
+	}
+	level, err := log.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatalf("toolexec: invalid log level: %s", *logLevel)
+	}
+	log.SetLevel(level)
+	if *lockFile == "" {
+		*lockFile = filepath.Join(weaveDir, "weaver.lock")
+	}
+
+	tool, toolArgs := args[0], args[1:]
+	if strings.TrimSuffix(filepath.Base(tool), ".exe") != "compile" {
+		return run(tool, toolArgs)
+	}
+	for _, a := range toolArgs {
+		if a == "-V=full" {
+			return compileVersion(tool, toolArgs, weaveDir)
+		}
+	}
+
+	p, importcfg, files := compileArgs(toolArgs)
+	all, err := findWeaves(weaveDir)
+	if err != nil {
+		log.Fatalf("toolexec: %+v", err)
+	}
+	weaves := all[p]
+	if len(weaves) == 0 {
+		return run(tool, toolArgs)
+	}
+
+	tmp, err := ioutil.TempDir("", "weaver-toolexec")
+	if err != nil {
+		log.Fatalf("toolexec: error creating temporary directory err: %+v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	mgr := pkg.NewToolexecManager(tmp, importcfg)
+	wp := weave.New(weaves)
+	// Compiles run in parallel, the lock file is only read
+	wp.UseLock(weave.OpenLock(*lockFile, *drift, false))
+	s := pkg.NewPackageFromFiles(p, files, mgr)
+	s.ApplyWeave(wp)
+	for _, o := range wp.Report() {
+		switch o.Status {
+		case weave.Unmatched:
+			log.Warnf("toolexec: %s: %s: %s %s never matched", p, o.File, o.Op, o.Name)
+		case weave.Drifted:
+			if *drift == weave.DriftFail {
+				log.Errorf("toolexec: %s: %s: %s %s refused, its original changed upstream, run weaver -updateLock", p, o.File, o.Op, o.Name)
+				return 1
+			}
+		}
+	}
+
+	// The files come last, the weaves may have generated new ones
+	var flags, goFiles []string
+	for _, a := range toolArgs {
+		if strings.HasSuffix(a, ".go") && !strings.HasPrefix(a, "-") {
+			goFiles = append(goFiles, a)
+		} else {
+			flags = append(flags, a)
+		}
+	}
+	return run(tool, append(flags, mgr.Files(goFiles)...))
+}
+
+// compileArgs returns the import path, import config and Go files of a compile invocation
+func compileArgs(args []string) (p string, importcfg string, files []string) {
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case a == "-p" && i+1 < len(args):
+			i++
+			p = args[i]
+		case a == "-importcfg" && i+1 < len(args):
+			i++
+			importcfg = args[i]
+		case strings.HasSuffix(a, ".go") && !strings.HasPrefix(a, "-"):
+			files = append(files, a)
+		}
+	}
+	return
+}
+
+// compileVersion answers the go command's compile -V=full query. The go command keys its build cache on the answer
+// so the hash of the weaves is added to it, changing a weave recompiles everything.
+func compileVersion(tool string, args []string, weaveDir string) int {
+	cmd := exec.Command(tool, args...)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		log.Errorf("compileVersion: %s -V=full err: %+v", tool, err)
+		return 1
+	}
+	fmt.Println(versionWithWeaves(strings.TrimSpace(stdout.String()), weavesHash(weaveDir)))
+	return 0
+}
+
+// versionWithWeaves adds hash h of the weaves to the compiler's version line
+func versionWithWeaves(line string, h string) string {
+	// Development toolchains only use the content ID at the end of the buildID field
+	if f := strings.Fields(line); len(f) > 2 && f[2] == "devel" && strings.HasPrefix(f[len(f)-1], "buildID=") {
+		return line + "-gweaver" + h
+	}
+	return line + " gweaver=" + h
+}
+
+// weavesHash hashes the gweaver version and every file of weaveDir
+func weavesHash(weaveDir string) string {
+	var files []string
+	filepath.Walk(weaveDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", pkg.Version)
+	for _, fn := range files {
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			log.Errorf("weavesHash: error reading: %s err: %+v", fn, err)
+			continue
+		}
+		fmt.Fprintf(h, "%s %x\n", filepath.ToSlash(fn), sha256.Sum256(b))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// run runs a tool passing its exit code on
+func run(tool string, args []string) int {
+	cmd := exec.Command(tool, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if exit, ok := err.(*exec.ExitError); ok {
+			return exit.ExitCode()
+		}
+		log.Errorf("run: %s err: %+v", tool, err)
+		return 1
+	}
+	return 0
+}
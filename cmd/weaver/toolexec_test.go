@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestIsTool(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want bool
+	}{
+		{arg: "/usr/local/go/pkg/tool/linux_amd64/compile", want: true},
+		{arg: "/usr/local/go/pkg/tool/linux_amd64/asm", want: true},
+		{arg: "test"},
+		{arg: "toolexec"},
+		{arg: "pkg/tool/linux_amd64/compile"},
+		{arg: "/usr/local/bin/compile"},
+	}
+	for _, tt := range tests {
+		if got := isTool(tt.arg); got != tt.want {
+			t.Errorf("isTool(%s): %t want: %t", tt.arg, got, tt.want)
+		}
+	}
+}
+
+func TestCompileArgs(t *testing.T) {
+	args := []string{"-o", "/tmp/b001/_pkg_.a", "-trimpath", "/tmp/b001=>", "-p", "net/http", "-lang=go1.21", "-importcfg", "/tmp/b001/importcfg", "-pack", "-c=4", "/goroot/src/net/http/client.go", "/goroot/src/net/http/server.go"}
+	p, importcfg, files := compileArgs(args)
+	if p != "net/http" || importcfg != "/tmp/b001/importcfg" || strings.Join(files, " ") != "/goroot/src/net/http/client.go /goroot/src/net/http/server.go" {
+		t.Errorf("compileArgs: p: %s importcfg: %s files: %v", p, importcfg, files)
+	}
+	// A trailing flag without its value is ignored
+	if p, importcfg, files := compileArgs([]string{"-V=full", "-p"}); p != "" || importcfg != "" || len(files) != 0 {
+		t.Errorf("compileArgs: p: %s importcfg: %s files: %v", p, importcfg, files)
+	}
+}
+
+func TestVersionWithWeaves(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{name: "release", line: "compile version go1.21.3", want: "compile version go1.21.3 gweaver=abc"},
+		{name: "devel", line: "compile version devel go1.22-f1c8e7b Tue Jan 2 15:04:05 2024 +0000 buildID=a1b2c3", want: "compile version devel go1.22-f1c8e7b Tue Jan 2 15:04:05 2024 +0000 buildID=a1b2c3-gweaverabc"},
+		{name: "devel without a build ID", line: "compile version devel go1.22-f1c8e7b", want: "compile version devel go1.22-f1c8e7b gweaver=abc"},
+	}
+	for _, tt := range tests {
+		if got := versionWithWeaves(tt.line, "abc"); got != tt.want {
+			t.Errorf("%s: %s want: %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCompileVersion(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake compiler is a shell script")
+	}
+	dir := t.TempDir()
+	tool := filepath.Join(dir, "compile")
+	if err := ioutil.WriteFile(tool, []byte("#!/bin/sh\necho compile version go1.21.3\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	weaveDir := filepath.Join(dir, "ext")
+	weave := filepath.Join(weaveDir, "fmt", "print.go")
+	if err := os.MkdirAll(filepath.Dir(weave), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(weave, []byte("package fmt\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	code := compileVersion(tool, []string{"-V=full"}, weaveDir)
+	os.Stdout = stdout
+	w.Close()
+	out, _ := ioutil.ReadAll(r)
+	if code != 0 {
+		t.Fatalf("compileVersion: exit code: %d", code)
+	}
+	first := string(out)
+	if want := "compile version go1.21.3 gweaver=" + weavesHash(weaveDir) + "\n"; first != want {
+		t.Errorf("compileVersion: %q want: %q", first, want)
+	}
+	if err := ioutil.WriteFile(weave, []byte("package fmt\n\n// +weaver delete\nfunc Println() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if changed := weavesHash(weaveDir); strings.HasSuffix(strings.TrimSpace(first), changed) {
+		t.Errorf("the hash of the weaves did not change: %s", changed)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gweaver/pkg"
+	"gweaver/weave"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type packageReport struct {
+	Package    string           `json:"package"`
+	Operations []weave.OpReport `json:"operations"`
+}
+
+type report struct {
+	Packages  []packageReport `json:"packages"`
+	Applied   int             `json:"applied"`
+	Unmatched int             `json:"unmatched"`
+	Ambiguous int             `json:"ambiguous"`
+	Drifted   int             `json:"drifted"`
+	// OutOfRange lists the target files none of whose weave variants accept the module version
+	OutOfRange []string `json:"outOfRange"`
+}
+
+// options are the flags of a weaving run
+type options struct {
+	weaveDir   string
+	writeDir   string
+	tag        string
+	reportFile string
+	strict     bool
+	lockFile   string
+	drift      string
+	updateLock bool
+	outOfRange string
+	patchDir   string
+	proxyDir   string
+	stdDir     string
+	contexts   []pkg.BuildContext
+	// goMod is the go.mod file the forks are added to, empty for ./go.mod
+	goMod string
+}
+
+// Usage:
+//
+//	weaver [flags]                  weave into forks of the target modules and point go.mod at them
+//	weaver test [flags] -- [args]   weave into temporary forks, run go test args against them and clean up
+//	go build -toolexec=weaver       weave packages as they are compiled, see toolexec
+func main() {
+	if len(os.Args) > 1 && (os.Args[1] == "toolexec" || isTool(os.Args[1])) {
+		os.Exit(toolexec(os.Args[1:]))
+	}
+	test := len(os.Args) > 1 && os.Args[1] == "test"
+	if test {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
+	var o options
+	flag.StringVar(&o.weaveDir, "weaveDir", "ext", "directory holding the weaves, one sub-directory per fully qualified package path")
+	flag.StringVar(&o.writeDir, "writeDir", "", "root directory for the forked modules, defaults to the module cache")
+	flag.StringVar(&o.tag, "tag", "woven", "tag appended to the version of a forked module")
+	logLevel := flag.String("logLevel", "info", "log level: trace, debug, info, warn, error")
+	flag.StringVar(&o.reportFile, "report", "-", "file the JSON weave report is written to, - for stdout, empty to disable")
+	flag.BoolVar(&o.strict, "strict", false, "fail the run if any weave operation never matched its target")
+	flag.StringVar(&o.lockFile, "lock", "", "lock file pinning the originals of woven declarations, defaults to weaver.lock in weaveDir, weaver test keeps it with the temporary forks")
+	flag.StringVar(&o.drift, "drift", weave.DriftFail, "what to do when a pinned original changed upstream: fail or warn")
+	flag.BoolVar(&o.updateLock, "updateLock", false, "accept upstream changes and re-pin drifted originals")
+	flag.StringVar(&o.outOfRange, "outOfRange", "skip", "what to do when no weave variant accepts the module version: skip or fail")
+	flag.StringVar(&o.patchDir, "patchDir", "", "directory to write a patch of the changes to each woven module to, empty to disable")
+	flag.StringVar(&o.proxyDir, "proxyDir", "", "directory to publish the woven modules to as a GOPROXY=file://dir module proxy, empty to disable")
+	flag.StringVar(&o.stdDir, "stdDir", "std-woven", "directory for woven standard library and main module files and the overlay.json to build them with")
+	platforms := flag.String("platforms", "", "comma separated GOOS/GOARCH platforms to weave the files of, defaults to the host platform")
+	tags := flag.String("tags", "", "comma separated build tags to weave the files of")
+	flag.BoolVar(&pkg.TrimPath, "trimpath", false, "name the files of //line directives relative like go build -trimpath, forks built on different machines are then identical")
+	flag.Parse()
+
+	if o.outOfRange != "skip" && o.outOfRange != "fail" {
+		log.Fatalf("weaver: invalid -outOfRange: %s", o.outOfRange)
+	}
+	level, err := log.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatalf("weaver: invalid log level: %s", *logLevel)
+	}
+	log.SetLevel(level)
+	if o.contexts, err = pkg.ParseBuildContexts(*platforms, *tags); err != nil {
+		log.Fatalf("weaver: invalid -platforms: %+v", err)
+	}
+
+	if test {
+		set := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		if !set["weaveDir"] {
+			o.weaveDir = testWeaveDir
+		}
+		if !set["report"] {
+			o.reportFile = ""
+		}
+		os.Exit(weaverTest(o, flag.Args()))
+	}
+	if o.lockFile == "" {
+		o.lockFile = filepath.Join(o.weaveDir, "weaver.lock")
+	}
+	if _, err := weaveRun(o); err != nil {
+		log.Errorf("weaver: %+v", err)
+		os.Exit(1)
+	}
+}
+
+// weaveRun weaves the packages of o.weaveDir and returns the overlay of the woven standard library and main module
+// files, empty when there are none. The error says why the run failed.
+func weaveRun(o options) (overlay string, err error) {
+	weaves, err := findWeaves(o.weaveDir)
+	if err != nil {
+		return "", err
+	}
+	if len(weaves) == 0 {
+		log.Warnf("weaver: no weaves found in: %s", o.weaveDir)
+	}
+	lock := weave.OpenLock(o.lockFile, o.drift, o.updateLock)
+
+	mgr := pkg.NewModManager(o.writeDir, o.tag, o.goMod)
+	// Standard library packages and those of the main module cannot be forked, they are woven through an overlay
+	mainModule, mainDir := pkg.MainModule()
+	var std *pkg.GoRootManager
+	stdMgr := func() *pkg.GoRootManager {
+		if std == nil {
+			std = pkg.NewGoRootManager(o.stdDir)
+		}
+		return std
+	}
+	// The weaves are Go packages too when they are kept in the main module, they are never woven
+	weavePkgs := ""
+	if abs, err := filepath.Abs(o.weaveDir); err == nil && mainDir != "" {
+		if rel, err := filepath.Rel(mainDir, abs); err == nil && !strings.HasPrefix(rel, "..") {
+			weavePkgs = path.Join(mainModule, filepath.ToSlash(rel))
+		}
+	}
+	r := weaveAll(weaves, lock, mgr, stdMgr, mainModule, weavePkgs, o.contexts)
+	// A fork missing the refused operations would quietly build, the run is undone instead
+	refused := r.Drifted > 0 && o.drift == weave.DriftFail && !o.updateLock
+	switch {
+	case refused:
+		mgr.Rollback()
+		if std != nil {
+			std.Discard()
+		}
+	default:
+		mgr.Commit()
+		if std != nil {
+			std.WriteOverlay()
+			overlay = std.Overlay()
+		}
+	}
+
+	lock.Save()
+	if o.patchDir != "" && !refused {
+		mgr.WritePatches(o.patchDir)
+	}
+	if o.proxyDir != "" && !refused {
+		mgr.WriteProxy(o.proxyDir)
+	}
+	writeReport(o.reportFile, &r)
+	return overlay, r.failed(o, refused)
+}
+
+// failed says why the run fails, nil when it does not: with -strict operations that never matched fail it, as do
+// refused operations and, with -outOfRange fail, targets no weave variant accepts
+func (r *report) failed(o options, refused bool) error {
+	var failures []string
+	if o.strict && r.Unmatched > 0 {
+		failures = append(failures, fmt.Sprintf("%d weave operations never matched", r.Unmatched))
+	}
+	if refused {
+		failures = append(failures, fmt.Sprintf("%d weave operations refused, their originals changed upstream, nothing was written, see -updateLock", r.Drifted))
+	}
+	if len(r.OutOfRange) > 0 && o.outOfRange == "fail" {
+		failures = append(failures, "no weave variant accepts the module version of: "+strings.Join(r.OutOfRange, ", "))
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(failures, ", "))
+}
+
+// weaveAll applies the weaves of each package and collects the outcome of every operation. The packages of the
+// standard library and the main module are overlaid through the manager std returns, the others go to mgr. The
+// packages outside the main module go first, the calls of their functions whose signatures change are rewritten in
+// the packages of the main module, but those of weavePkgs, when their weaves ask for it.
+func weaveAll(weaves map[string][]string, lock *weave.Lock, mgr *pkg.ModManager, std func() *pkg.GoRootManager, mainModule string, weavePkgs string, contexts []pkg.BuildContext) (r report) {
+	var mainPkgs []string
+	var callers []*weave.Signature
+	for _, p := range sortedKeys(weaves) {
+		if pkg.InModule(p, mainModule) {
+			mainPkgs = append(mainPkgs, p)
+			continue
+		}
+		var m pkg.PackageManager = mgr
+		if pkg.IsStdlib(p) {
+			m = std()
+		}
+		wp := weave.New(weaves[p])
+		weaveOne(p, wp, lock, m, contexts, &r)
+		callers = append(callers, wp.MainSignatures()...)
+	}
+	if len(callers) > 0 && mainModule != "" {
+		woven := make(map[string]bool)
+		for _, p := range mainPkgs {
+			woven[p] = true
+		}
+		for _, p := range pkg.ModulePackages(mainModule) {
+			if !woven[p] && !pkg.InModule(p, weavePkgs) {
+				mainPkgs = append(mainPkgs, p)
+			}
+		}
+		sort.Strings(mainPkgs)
+	}
+	for _, p := range mainPkgs {
+		wp := weave.New(weaves[p])
+		wp.AddCallers(callers)
+		weaveOne(p, wp, lock, std(), contexts, &r)
+		if s := wp.MainSignatures(); len(s) > 0 {
+			log.Warnf("weaver: %s: the calls of: %s in other packages of the main module are not rewritten, main only applies to the signatures of other modules", p, s[0].Name)
+		}
+	}
+	return
+}
+
+// weaveOne applies weaves wp to package p and adds the outcome of their operations to r, a package without weaves
+// of its own is left out of the report
+func weaveOne(p string, wp *weave.Pkg, lock *weave.Lock, m pkg.PackageManager, contexts []pkg.BuildContext, r *report) {
+	wp.UseLock(lock)
+	s := pkg.NewPackage(p, m, wp.HasTestWeaves(), contexts)
+	s.ApplyWeave(wp)
+	if wp.Empty() {
+		return
+	}
+	r.add(p, wp.Report(), wp.OutOfRange())
+}
+
+// add counts the outcome of operations ops of package p, outOfRange are the target files of p no weave variant
+// accepts the module version of
+func (r *report) add(p string, ops []weave.OpReport, outOfRange []string) {
+	pr := packageReport{Package: p, Operations: ops}
+	for _, o := range pr.Operations {
+		switch o.Status {
+		case weave.Applied:
+			r.Applied++
+		case weave.Unmatched:
+			r.Unmatched++
+			log.Warnf("weaver: %s: %s: %s %s never matched", p, o.File, o.Op, o.Name)
+		case weave.Ambiguous:
+			r.Ambiguous++
+			log.Warnf("weaver: %s: %s: %s %s matched %d times", p, o.File, o.Op, o.Name, o.Matches)
+		case weave.Drifted:
+			r.Drifted++
+		}
+	}
+	for _, f := range outOfRange {
+		r.OutOfRange = append(r.OutOfRange, p+"/"+f)
+	}
+	r.Packages = append(r.Packages, pr)
+}
+
+// findWeaves maps each package path under weaveDir to the weave files it holds
+func findWeaves(weaveDir string) (weaves map[string][]string, err error) {
+	weaves = make(map[string][]string)
+	err = filepath.Walk(weaveDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, ".go") {
+			return nil
+		}
+		rel, err := filepath.Rel(weaveDir, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		p := filepath.ToSlash(rel)
+		weaves[p] = append(weaves[p], path)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("findWeaves: error reading weave directory: %s err: %+v", weaveDir, err)
+	}
+	return
+}
+
+func sortedKeys(m map[string][]string) (keys []string) {
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return
+}
+
+func writeReport(fn string, r *report) {
+	if fn == "" {
+		return
+	}
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		log.Fatalf("weaver: error encoding report: %+v", err)
+	}
+	b = append(b, '\n')
+	if fn == "-" {
+		os.Stdout.Write(b)
+		return
+	}
+	if err := ioutil.WriteFile(fn, b, 0644); err != nil {
+		log.Errorf("weaver: error writing report: %s err: %+v", fn, err)
+	}
+}
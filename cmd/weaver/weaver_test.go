@@ -0,0 +1,51 @@
+package main
+
+import (
+	"gweaver/weave"
+	"testing"
+)
+
+func TestReport(t *testing.T) {
+	var r report
+	r.add("example.com/a", []weave.OpReport{
+		{File: "a.go", Op: "replace", Name: "f", Matches: 1, Status: weave.Applied},
+		{File: "a.go", Op: "delete", Name: "g", Status: weave.Unmatched},
+		{File: "a.go", Op: "replace", Name: "String", Matches: 2, Status: weave.Ambiguous},
+	}, nil)
+	r.add("example.com/b", []weave.OpReport{
+		{File: "b.go", Op: "insert", Name: "h", Matches: 1, Status: weave.Applied},
+		{File: "b.go", Op: "replace", Name: "k", Matches: 1, Status: weave.Drifted},
+		{File: "b_old.go", Op: "replace", Name: "k", Status: weave.Skipped},
+	}, []string{"c.go"})
+	if r.Applied != 2 || r.Unmatched != 1 || r.Ambiguous != 1 || r.Drifted != 1 || len(r.Packages) != 2 {
+		t.Errorf("report: applied: %d unmatched: %d ambiguous: %d drifted: %d packages: %d", r.Applied, r.Unmatched, r.Ambiguous, r.Drifted, len(r.Packages))
+	}
+	if len(r.OutOfRange) != 1 || r.OutOfRange[0] != "example.com/b/c.go" {
+		t.Errorf("out of range: %v", r.OutOfRange)
+	}
+
+	tests := []struct {
+		name    string
+		o       options
+		refused bool
+		want    string
+	}{
+		{name: "default", o: options{outOfRange: "skip"}},
+		{name: "strict", o: options{strict: true, outOfRange: "skip"}, want: "1 weave operations never matched"},
+		{name: "refused", o: options{outOfRange: "skip"}, refused: true, want: "1 weave operations refused, their originals changed upstream, nothing was written, see -updateLock"},
+		{name: "out of range", o: options{outOfRange: "fail"}, want: "no weave variant accepts the module version of: example.com/b/c.go"},
+	}
+	for _, tt := range tests {
+		got := ""
+		if err := r.failed(tt.o, tt.refused); err != nil {
+			got = err.Error()
+		}
+		if got != tt.want {
+			t.Errorf("%s: failed: %q want: %q", tt.name, got, tt.want)
+		}
+	}
+	// Without unmatched operations -strict passes
+	if err := (&report{Applied: 1}).failed(options{strict: true}, false); err != nil {
+		t.Errorf("strict: failed: %+v with every operation applied", err)
+	}
+}
@@ -0,0 +1,233 @@
+/*
+Package diff computes line based differences and prints them in the unified format understood by patch and git apply
+*/
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Op is the kind of change an Edit makes
+type Op int
+
+const (
+	Equal Op = iota
+	Delete
+	Insert
+)
+
+// Edit is a single line of a diff
+type Edit struct {
+	Op   Op
+	Line string
+}
+
+const context = 3
+
+// SplitLines splits s into lines, each keeps its trailing newline so a missing final newline survives a round trip
+func SplitLines(s string) (lines []string) {
+	for len(s) > 0 {
+		i := strings.IndexByte(s, '\n')
+		if i < 0 {
+			lines = append(lines, s)
+			break
+		}
+		lines = append(lines, s[:i+1])
+		s = s[i+1:]
+	}
+	return
+}
+
+// Lines returns the shortest edit script turning a into b (Myers' algorithm)
+func Lines(a, b []string) (edits []Edit) {
+	// Trimming the common prefix and suffix keeps D, and so the trace, small for typical patches
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	for _, l := range a[:pre] {
+		edits = append(edits, Edit{Equal, l})
+	}
+	edits = append(edits, myers(a[pre:len(a)-suf], b[pre:len(b)-suf])...)
+	for _, l := range a[len(a)-suf:] {
+		edits = append(edits, Edit{Equal, l})
+	}
+	return
+}
+
+func myers(a, b []string) []Edit {
+	n, m := len(a), len(b)
+	max := n + m
+	if max == 0 {
+		return nil
+	}
+	// v[k+max] is the furthest x reached on diagonal k, trace keeps v as it was before each round
+	v := make([]int, 2*max+2)
+	var trace [][]int
+	for d := 0; d <= max; d++ {
+		snap := make([]int, 2*d+3)
+		for k := -d - 1; k <= d+1; k++ {
+			if k+max >= 0 && k+max < len(v) {
+				snap[k+d+1] = v[k+max]
+			}
+		}
+		trace = append(trace, snap)
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[k-1+max] < v[k+1+max]) {
+				x = v[k+1+max]
+			} else {
+				x = v[k-1+max] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[k+max] = x
+			if x >= n && y >= m {
+				return backtrack(trace, a, b)
+			}
+		}
+	}
+	return nil
+}
+
+func backtrack(trace [][]int, a, b []string) []Edit {
+	x, y := len(a), len(b)
+	var rev []Edit
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		at := func(k int) int { return v[k+d+1] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := 0
+		if d > 0 {
+			prevX = at(prevK)
+		}
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			rev = append(rev, Edit{Equal, a[x]})
+		}
+		if d > 0 {
+			if x == prevX {
+				y--
+				rev = append(rev, Edit{Insert, b[y]})
+			} else {
+				x--
+				rev = append(rev, Edit{Delete, a[x]})
+			}
+		}
+	}
+	edits := make([]Edit, len(rev))
+	for i, e := range rev {
+		edits[len(rev)-1-i] = e
+	}
+	return edits
+}
+
+// Unified returns the unified diff from a to b, it is empty when they are equal
+func Unified(fromName, toName, a, b string) string {
+	edits := Lines(SplitLines(a), SplitLines(b))
+	changed := false
+	for _, e := range edits {
+		if e.Op != Equal {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return ""
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", fromName, toName)
+	for i := 0; i < len(edits); {
+		if edits[i].Op == Equal {
+			i++
+			continue
+		}
+		// Grow the hunk until there are more than 2*context unchanged lines in a row
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(edits); j++ {
+			if edits[j].Op != Equal {
+				end = j + 1
+			} else if j-end >= 2*context {
+				break
+			}
+		}
+		stop := end + context
+		if stop > len(edits) {
+			stop = len(edits)
+		}
+		writeHunk(&sb, edits, start, stop)
+		i = stop
+	}
+	return sb.String()
+}
+
+func writeHunk(sb *strings.Builder, edits []Edit, start, stop int) {
+	// Line numbers of the hunk start are 1 based and count the lines before it on each side
+	aLine, bLine := 1, 1
+	for _, e := range edits[:start] {
+		if e.Op != Insert {
+			aLine++
+		}
+		if e.Op != Delete {
+			bLine++
+		}
+	}
+	aCount, bCount := 0, 0
+	for _, e := range edits[start:stop] {
+		if e.Op != Insert {
+			aCount++
+		}
+		if e.Op != Delete {
+			bCount++
+		}
+	}
+	// An empty range starts at the line before it
+	if aCount == 0 {
+		aLine--
+	}
+	if bCount == 0 {
+		bLine--
+	}
+	fmt.Fprintf(sb, "@@ -%s +%s @@\n", hunkRange(aLine, aCount), hunkRange(bLine, bCount))
+	for _, e := range edits[start:stop] {
+		prefix := " "
+		switch e.Op {
+		case Delete:
+			prefix = "-"
+		case Insert:
+			prefix = "+"
+		}
+		sb.WriteString(prefix + e.Line)
+		if !strings.HasSuffix(e.Line, "\n") {
+			sb.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+func hunkRange(line, count int) string {
+	if count == 1 {
+		return fmt.Sprintf("%d", line)
+	}
+	return fmt.Sprintf("%d,%d", line, count)
+}
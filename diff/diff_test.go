@@ -0,0 +1,108 @@
+package diff
+
+import (
+	"strings"
+	"testing"
+)
+
+// numbered returns lines "1\n" to "n\n", with line i replaced by the value of change when it has one
+func numbered(n int, change map[int]string) string {
+	var sb strings.Builder
+	for i := 1; i <= n; i++ {
+		if c, ok := change[i]; ok {
+			sb.WriteString(c)
+			continue
+		}
+		sb.WriteString(strings.Repeat("x", i) + "\n")
+	}
+	return sb.String()
+}
+
+func TestUnified(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{
+			name: "equal",
+			a:    "a\nb\n",
+			b:    "a\nb\n",
+			want: "",
+		},
+		{
+			name: "change",
+			a:    "a\nb\nc\n",
+			b:    "a\nB\nc\n",
+			want: "--- a\n+++ b\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n",
+		},
+		{
+			name: "new file",
+			a:    "",
+			b:    "a\nb\n",
+			want: "--- a\n+++ b\n@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			name: "deleted file",
+			a:    "a\n",
+			b:    "",
+			want: "--- a\n+++ b\n@@ -1 +0,0 @@\n-a\n",
+		},
+		{
+			name: "no newline at end of file",
+			a:    "a\nb",
+			b:    "a\nb\n",
+			want: "--- a\n+++ b\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n",
+		},
+		{
+			name: "context",
+			a:    numbered(10, nil),
+			b:    numbered(10, map[int]string{5: "five\n"}),
+			want: "--- a\n+++ b\n@@ -2,7 +2,7 @@\n xx\n xxx\n xxxx\n-xxxxx\n+five\n xxxxxx\n xxxxxxx\n xxxxxxxx\n",
+		},
+		{
+			name: "two hunks",
+			a:    numbered(12, nil),
+			b:    numbered(12, map[int]string{1: "one\n", 12: "twelve\n"}),
+			want: "--- a\n+++ b\n@@ -1,4 +1,4 @@\n-x\n+one\n xx\n xxx\n xxxx\n" +
+				"@@ -9,4 +9,4 @@\n xxxxxxxxx\n xxxxxxxxxx\n xxxxxxxxxxx\n-xxxxxxxxxxxx\n+twelve\n",
+		},
+		{
+			name: "one hunk when the changes are close",
+			a:    numbered(8, nil),
+			b:    numbered(8, map[int]string{1: "one\n", 8: "eight\n"}),
+			want: "--- a\n+++ b\n@@ -1,8 +1,8 @@\n-x\n+one\n xx\n xxx\n xxxx\n xxxxx\n xxxxxx\n xxxxxxx\n-xxxxxxxx\n+eight\n",
+		},
+		{
+			name: "insert",
+			a:    "a\nc\n",
+			b:    "a\nb\nc\n",
+			want: "--- a\n+++ b\n@@ -1,2 +1,3 @@\n a\n+b\n c\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Unified("a", "b", tt.a, tt.b); got != tt.want {
+				t.Errorf("Unified() =\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitLines(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []string
+	}{
+		{"", nil},
+		{"a", []string{"a"}},
+		{"a\n", []string{"a\n"}},
+		{"a\n\nb", []string{"a\n", "\n", "b"}},
+	}
+	for _, tt := range tests {
+		got := SplitLines(tt.s)
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+			t.Errorf("SplitLines(%q) = %q want: %q", tt.s, got, tt.want)
+		}
+	}
+}
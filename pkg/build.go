@@ -0,0 +1,98 @@
+package pkg
+
+import (
+	"fmt"
+	"go/build"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// BuildContext is a platform and set of build tags a package is loaded for, files excluded by the host's build
+// constraints are only woven when a context includes them
+type BuildContext struct {
+	GOOS   string
+	GOARCH string
+	Tags   []string
+}
+
+// unixOS lists the GOOS values satisfying the unix build constraint
+var unixOS = map[string]bool{"aix": true, "android": true, "darwin": true, "dragonfly": true, "freebsd": true, "hurd": true, "illumos": true, "ios": true, "linux": true, "netbsd": true, "openbsd": true, "solaris": true}
+
+// ParseBuildContexts builds the contexts for a comma separated list of GOOS/GOARCH platforms, each with the comma
+// separated build tags. No platform means the host's.
+func ParseBuildContexts(platforms string, tags string) (contexts []BuildContext, err error) {
+	var t []string
+	for _, tag := range strings.Split(tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			t = append(t, tag)
+		}
+	}
+	for _, p := range strings.Split(platforms, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		osArch := strings.Split(p, "/")
+		if len(osArch) != 2 || osArch[0] == "" || osArch[1] == "" {
+			return nil, fmt.Errorf("invalid platform, expected GOOS/GOARCH: %s", p)
+		}
+		contexts = append(contexts, BuildContext{GOOS: osArch[0], GOARCH: osArch[1], Tags: t})
+	}
+	if len(contexts) == 0 {
+		contexts = append(contexts, BuildContext{GOOS: build.Default.GOOS, GOARCH: build.Default.GOARCH, Tags: t})
+	}
+	return
+}
+
+func (c BuildContext) String() string {
+	if len(c.Tags) == 0 {
+		return c.GOOS + "/" + c.GOARCH
+	}
+	return c.GOOS + "/" + c.GOARCH + " tags: " + strings.Join(c.Tags, ",")
+}
+
+// env is the environment the go command loads the package with
+func (c BuildContext) env() []string {
+	return append(os.Environ(), "GOOS="+c.GOOS, "GOARCH="+c.GOARCH)
+}
+
+func (c BuildContext) buildFlags() []string {
+	if len(c.Tags) == 0 {
+		return nil
+	}
+	return []string{"-tags=" + strings.Join(c.Tags, ",")}
+}
+
+// native reports whether the context is the host platform, cgo is only on by default there
+func (c BuildContext) native() bool {
+	return c.GOOS == runtime.GOOS && c.GOARCH == runtime.GOARCH
+}
+
+// Tag reports whether build constraint tag is satisfied in the context
+func (c BuildContext) Tag(tag string) bool {
+	switch {
+	case tag == c.GOOS || tag == c.GOARCH || tag == runtime.Compiler:
+		return true
+	case tag == "unix":
+		return unixOS[c.GOOS]
+	case tag == "linux":
+		return c.GOOS == "android"
+	case tag == "darwin":
+		return c.GOOS == "ios"
+	case tag == "solaris":
+		return c.GOOS == "illumos"
+	case tag == "cgo":
+		return c.native() && build.Default.CgoEnabled
+	}
+	for _, r := range build.Default.ReleaseTags {
+		if tag == r {
+			return true
+		}
+	}
+	for _, t := range c.Tags {
+		if tag == t {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package pkg
+
+import (
+	"go/build"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestParseBuildContexts(t *testing.T) {
+	host := build.Default.GOOS + "/" + build.Default.GOARCH
+	tests := []struct {
+		platforms string
+		tags      string
+		// want lists the contexts, empty when parsing fails
+		want []string
+	}{
+		{want: []string{host}},
+		{platforms: " , ", tags: "integration", want: []string{host + " tags: integration"}},
+		{platforms: "linux/amd64", want: []string{"linux/amd64"}},
+		{platforms: "linux/amd64, windows/arm64", tags: "a, ,b", want: []string{"linux/amd64 tags: a,b", "windows/arm64 tags: a,b"}},
+		{platforms: "linux"},
+		{platforms: "linux/"},
+		{platforms: "/amd64"},
+		{platforms: "linux/amd64/v3"},
+	}
+	for _, tt := range tests {
+		contexts, err := ParseBuildContexts(tt.platforms, tt.tags)
+		var got []string
+		for _, c := range contexts {
+			got = append(got, c.String())
+		}
+		if (err != nil) != (len(tt.want) == 0) || strings.Join(got, ", ") != strings.Join(tt.want, ", ") {
+			t.Errorf("ParseBuildContexts(%q, %q): %v err: %v want: %v", tt.platforms, tt.tags, got, err, tt.want)
+		}
+	}
+}
+
+func TestBuildContextTag(t *testing.T) {
+	native := BuildContext{GOOS: runtime.GOOS, GOARCH: runtime.GOARCH}
+	tests := []struct {
+		name string
+		c    BuildContext
+		tag  string
+		want bool
+	}{
+		{name: "GOOS", c: BuildContext{GOOS: "windows", GOARCH: "amd64"}, tag: "windows", want: true},
+		{name: "other GOOS", c: BuildContext{GOOS: "windows", GOARCH: "amd64"}, tag: "linux"},
+		{name: "GOARCH", c: BuildContext{GOOS: "linux", GOARCH: "arm64"}, tag: "arm64", want: true},
+		{name: "compiler", c: BuildContext{GOOS: "linux", GOARCH: "arm64"}, tag: runtime.Compiler, want: true},
+		{name: "unix", c: BuildContext{GOOS: "darwin", GOARCH: "arm64"}, tag: "unix", want: true},
+		{name: "not unix", c: BuildContext{GOOS: "windows", GOARCH: "amd64"}, tag: "unix"},
+		{name: "android is linux", c: BuildContext{GOOS: "android", GOARCH: "arm64"}, tag: "linux", want: true},
+		{name: "ios is darwin", c: BuildContext{GOOS: "ios", GOARCH: "arm64"}, tag: "darwin", want: true},
+		{name: "illumos is solaris", c: BuildContext{GOOS: "illumos", GOARCH: "amd64"}, tag: "solaris", want: true},
+		{name: "linux is not android", c: BuildContext{GOOS: "linux", GOARCH: "arm64"}, tag: "android"},
+		{name: "cgo on the host", c: native, tag: "cgo", want: build.Default.CgoEnabled},
+		{name: "no cgo cross compiling", c: BuildContext{GOOS: "plan9", GOARCH: "386"}, tag: "cgo"},
+		{name: "release", c: native, tag: "go1.1", want: true},
+		{name: "future release", c: native, tag: "go1.999"},
+		{name: "build tag", c: BuildContext{GOOS: "linux", GOARCH: "amd64", Tags: []string{"integration"}}, tag: "integration", want: true},
+		{name: "missing build tag", c: BuildContext{GOOS: "linux", GOARCH: "amd64"}, tag: "integration"},
+	}
+	for _, tt := range tests {
+		if got := tt.c.Tag(tt.tag); got != tt.want {
+			t.Errorf("%s: %s Tag(%s): %t want: %t", tt.name, tt.c, tt.tag, got, tt.want)
+		}
+	}
+}
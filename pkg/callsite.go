@@ -0,0 +1,208 @@
+package pkg
+
+import (
+	log "github.com/sirupsen/logrus"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"golang.org/x/tools/go/ast/astutil"
+	"gweaver/weave"
+	"path"
+	"strings"
+)
+
+// weaveCallSites redirects the calls of file f resolved by info to the advice of the callsite weaves, the
+// declarations holding them are marked touched. It returns the weave of the last call redirected, nil if none was.
+func (p *source) weaveCallSites(sites []*weave.CallSite, info *types.Info, f *ast.File) (w *weave.Weave) {
+	if len(sites) == 0 {
+		return nil
+	}
+	fn := p.pkg.Fset.Position(f.Package).Filename
+	if info == nil {
+		log.Warnf("weaveCallSites: %s: no type information, its calls are not redirected", fn)
+		return nil
+	}
+	targets := make(map[string]*weave.CallSite)
+	for _, cs := range sites {
+		targets[cs.Target] = cs
+	}
+
+	// unused holds the packages of redirected targets, their imports may no longer be needed
+	unused := make(map[string]bool)
+	var imports []string
+	for _, d := range f.Decls {
+		ast.Inspect(d, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			obj, recv := calledFunc(info, call)
+			if obj == nil {
+				return true
+			}
+			cs, ok := targets[obj.FullName()]
+			if !ok {
+				return true
+			}
+			if recv != nil {
+				x, ok := receiverArg(info, recv, obj)
+				if !ok {
+					log.Warnf("weaveCallSites: %s: %s: unable to pass the receiver of: %s to its advice", fn, p.pkg.Fset.Position(call.Pos()), cs.Target)
+					return true
+				}
+				call.Args = append([]ast.Expr{x}, call.Args...)
+			}
+			call.Fun = p.qualified(info, f, cs.Path, cs.Advice, call.Fun.Pos())
+			if cs.Path != "" {
+				imports = append(imports, cs.Path)
+			}
+			if obj.Pkg() != nil {
+				unused[obj.Pkg().Path()] = true
+			}
+			log.Debugf("weaveCallSites: %s: %s: %s redirected to: %s", fn, p.pkg.Fset.Position(call.Pos()), cs.Target, cs.Advice)
+			p.touched[d] = true
+			cs.Redirected()
+			w = cs.Weave()
+			return true
+		})
+	}
+	for i := range unused {
+		if dropUnusedImport(p.pkg.Fset, f, i) {
+			p.touchImports()
+		}
+	}
+	p.mgr.requireImports(imports)
+	return
+}
+
+// calledFunc resolves the function or method a call invokes. recv is the receiver expression of a method call,
+// nil for functions and method expressions such as (*T).M(t).
+func calledFunc(info *types.Info, call *ast.CallExpr) (obj *types.Func, recv *ast.SelectorExpr) {
+	fun := call.Fun
+	for {
+		pe, ok := fun.(*ast.ParenExpr)
+		if !ok {
+			break
+		}
+		fun = pe.X
+	}
+	var id *ast.Ident
+	switch t := fun.(type) {
+	case *ast.Ident:
+		id = t
+	case *ast.SelectorExpr:
+		id = t.Sel
+		if sel, ok := info.Selections[t]; ok {
+			switch sel.Kind() {
+			case types.MethodVal:
+				recv = t
+			case types.FieldVal:
+				// A call of a func valued field
+				return nil, nil
+			}
+		}
+	default:
+		return nil, nil
+	}
+	obj, _ = info.Uses[id].(*types.Func)
+	return obj, recv
+}
+
+// receiverArg turns the receiver of method call sel into the first argument of the advice. The fields a promoted
+// method is reached through are spelled out and the receiver is addressed or dereferenced the way the method's
+// receiver type requires, the go spec does the same implicitly for method calls.
+func receiverArg(info *types.Info, sel *ast.SelectorExpr, obj *types.Func) (ast.Expr, bool) {
+	s := info.Selections[sel]
+	x, t := sel.X, s.Recv()
+	path := s.Index()
+	for _, i := range path[:len(path)-1] {
+		st, ok := deref(t).Underlying().(*types.Struct)
+		if !ok {
+			return nil, false
+		}
+		field := st.Field(i)
+		x = &ast.SelectorExpr{X: x, Sel: ast.NewIdent(field.Name())}
+		t = field.Type()
+	}
+	_, wantPtr := obj.Type().(*types.Signature).Recv().Type().(*types.Pointer)
+	_, isPtr := t.(*types.Pointer)
+	switch {
+	case wantPtr && !isPtr:
+		return &ast.UnaryExpr{Op: token.AND, X: x}, true
+	case !wantPtr && isPtr && !types.IsInterface(obj.Type().(*types.Signature).Recv().Type()):
+		return &ast.StarExpr{X: x}, true
+	}
+	return x, true
+}
+
+func deref(t types.Type) types.Type {
+	if pt, ok := t.(*types.Pointer); ok {
+		return pt.Elem()
+	}
+	return t
+}
+
+// qualified is the expression referring to name of package pkgPath from file f, which imports it if it does
+// not already. An empty pkgPath refers to name of the package itself. The expression is placed at pos, the position
+// of the expression it replaces, so it is printed where that one was.
+func (p *source) qualified(info *types.Info, f *ast.File, pkgPath string, name string, pos token.Pos) ast.Expr {
+	if pkgPath == "" {
+		return &ast.Ident{NamePos: pos, Name: name}
+	}
+	pkg := importName(info, f, pkgPath)
+	if pkg == "" {
+		// Package names are not always the last element of the path, e.g. gopkg.in/yaml.v2, such imports are named
+		pkg = strings.Map(func(r rune) rune {
+			if r == '.' || r == '-' {
+				return '_'
+			}
+			return r
+		}, path.Base(pkgPath))
+		if pkg == path.Base(pkgPath) {
+			astutil.AddImport(p.pkg.Fset, f, pkgPath)
+		} else {
+			astutil.AddNamedImport(p.pkg.Fset, f, pkg, pkgPath)
+		}
+		p.touchImports()
+	}
+	return &ast.SelectorExpr{X: &ast.Ident{NamePos: pos, Name: pkg}, Sel: &ast.Ident{NamePos: pos, Name: name}}
+}
+
+// importName is the name package path is imported as in f, empty if f does not import it or only for its side
+// effects or with a dot
+func importName(info *types.Info, f *ast.File, path string) string {
+	for _, is := range f.Imports {
+		if pathFix(is.Path.Value) != path {
+			continue
+		}
+		switch {
+		case is.Name == nil:
+			if pn, ok := info.Implicits[is].(*types.PkgName); ok {
+				return pn.Name()
+			}
+		case is.Name.Name != "_" && is.Name.Name != ".":
+			return is.Name.Name
+		}
+	}
+	return ""
+}
+
+// dropUnusedImport deletes the import of package path from f when no selector refers to it any longer
+func dropUnusedImport(fset *token.FileSet, f *ast.File, path string) bool {
+	if astutil.UsesImport(f, path) {
+		return false
+	}
+	for _, is := range f.Imports {
+		if pathFix(is.Path.Value) != path {
+			continue
+		}
+		if is.Name != nil {
+			if is.Name.Name == "_" || is.Name.Name == "." {
+				return false
+			}
+			return astutil.DeleteNamedImport(fset, f, is.Name.Name, path)
+		}
+		return astutil.DeleteImport(fset, f, path)
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package pkg
+
+import "testing"
+
+// callsiteTarget calls a function and a method of another package
+const callsiteTarget = `package target
+
+import "strings"
+
+func shout(s string) string { return strings.ToUpper(s) + "!" }
+
+func build() string {
+	var b strings.Builder
+	b.WriteString("x")
+	return b.String()
+}
+`
+
+func TestWeaveCallSites(t *testing.T) {
+	tests := []struct {
+		name  string
+		weave string
+		// status is the outcome of the operations, want what the woven file holds and gone the call redirected
+		status string
+		want   []string
+		gone   string
+	}{
+		{
+			name:   "advice of the weave",
+			weave:  "// +weaver callsite strings.ToUpper\nfunc loud(s string) string { return s }\n",
+			status: "callsite strings.ToUpper: applied, insert loud: applied",
+			want:   []string{"func loud(s string) string { return s }\n", `return loud(s) + "!"`},
+			gone:   "strings.ToUpper(s)",
+		},
+		{
+			name:   "advice of another package",
+			weave:  "import \"strings\"\n\n// +weaver callsite strings.ToUpper strings.ToLower\n",
+			status: "callsite strings.ToUpper: applied",
+			want:   []string{`return strings.ToLower(s) + "!"`},
+			gone:   "strings.ToUpper(s)",
+		},
+		{
+			name:   "method",
+			weave:  "import \"strings\"\n\n// +weaver callsite (*strings.Builder).WriteString\nfunc write(b *strings.Builder, s string) (int, error) { return b.WriteString(s + s) }\n",
+			status: "callsite (*strings.Builder).WriteString: applied, insert write: applied",
+			want:   []string{"func write(b *strings.Builder, s string) (int, error)", "\twrite(&b, \"x\")\n"},
+			gone:   `b.WriteString("x")`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, wp := weaveTarget(t, map[string]string{"target.go": callsiteTarget}, map[string]string{"target.go": "package target\n\n" + tt.weave})
+			if s := statuses(wp); s != tt.status {
+				t.Errorf("operations: %s want: %s", s, tt.status)
+			}
+			contains(t, m, "target.go", tt.want...)
+			lacks(t, m, "target.go", tt.gone)
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go/format"
+	"go/token"
+	"go/types"
+	"gweaver/weave"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// exposeFile is the file of the package the declarations exposing unexported ones are generated into
+const exposeFile = "gweaver_expose.go"
+
+// weaveExposes generates the exported declarations of the expose weaves into a new file of the package, the
+// declarations they expose are left alone
+func (p *source) weaveExposes(exposes []*weave.Expose) {
+	if len(exposes) == 0 {
+		return
+	}
+	pp := p.pkg
+	if pp.Types == nil || len(pp.GoFiles) == 0 {
+		log.Warnf("weaveExposes: %s: no type information, nothing is exposed", pp.PkgPath)
+		return
+	}
+	fn := filepath.Join(filepath.Dir(pp.GoFiles[0]), exposeFile)
+	// imports maps the packages the generated declarations refer to to their names
+	imports := make(map[string]string)
+	qualifier := func(pkg *types.Package) string {
+		if pkg == pp.Types {
+			return ""
+		}
+		imports[pkg.Path()] = pkg.Name()
+		return pkg.Name()
+	}
+
+	var decls [][]byte
+	var weaves []*weave.Weave
+	taken := make(map[string]bool)
+	for _, e := range exposes {
+		text, ok := p.expose(e, pp.Types, qualifier, taken)
+		if !ok {
+			continue
+		}
+		decls = append(decls, withProvenance([]byte(text), provenanceOf("expose", e.Weave())))
+		if len(weaves) == 0 || weaves[len(weaves)-1] != e.Weave() {
+			weaves = append(weaves, e.Weave())
+		}
+		e.Exposed()
+	}
+	if len(decls) == 0 {
+		return
+	}
+
+	var b bytes.Buffer
+	b.WriteString(generatedHeader)
+	fmt.Fprintf(&b, "package %s\n\n", pp.Name)
+	var paths []string
+	for p := range imports {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, ip := range paths {
+		if imports[ip] == path.Base(ip) {
+			fmt.Fprintf(&b, "import %s\n", strconv.Quote(ip))
+		} else {
+			fmt.Fprintf(&b, "import %s %s\n", imports[ip], strconv.Quote(ip))
+		}
+	}
+	b.WriteString("\n")
+	b.Write(bytes.Join(decls, []byte("\n\n")))
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		log.Errorf("weaveExposes: %s: generated source is not valid Go, writing it unformatted err: %+v", fn, err)
+		src = b.Bytes()
+	}
+	p.mgr.writeWovenFile(src, bytes.TrimPrefix(src, []byte(generatedHeader)), fn)
+	for _, w := range weaves {
+		p.mgr.recordWoven(fn, w)
+	}
+}
+
+// expose generates the exported declarations of expose e in package pkg, names are the names taken already by
+// earlier ones. ok is false when there is nothing to expose.
+func (p *source) expose(e *weave.Expose, pkg *types.Package, qualifier types.Qualifier, names map[string]bool) (text string, ok bool) {
+	scope := pkg.Scope()
+	exported := e.Exported()
+	typ, member, isMember := e.Member()
+	if token.IsExported(member) {
+		log.Warnf("weaveExposes: %s is exported already", e.Name)
+		return "", false
+	}
+	// free reports whether the names are neither declared nor generated yet, lookup finds the declared ones
+	free := func(lookup func(name string) bool, want ...string) bool {
+		for _, n := range want {
+			if lookup(n) || names[typ+"."+n] {
+				log.Warnf("weaveExposes: %s cannot be exposed, %s is taken", e.Name, n)
+				return false
+			}
+		}
+		for _, n := range want {
+			names[typ+"."+n] = true
+		}
+		return true
+	}
+	doc := fmt.Sprintf("// %s exposes %s.\n", exported, member)
+
+	if !isMember {
+		obj := scope.Lookup(member)
+		if obj == nil {
+			log.Warnf("weaveExposes: %s is not declared in: %s", e.Name, pkg.Path())
+			return "", false
+		}
+		declared := func(name string) bool { return scope.Lookup(name) != nil }
+		switch o := obj.(type) {
+		case *types.TypeName:
+			if named, ok := o.Type().(*types.Named); ok && named.TypeParams().Len() > 0 {
+				log.Warnf("weaveExposes: %s is generic, it cannot be aliased", e.Name)
+				return "", false
+			}
+			if !free(declared, exported) {
+				return "", false
+			}
+			return fmt.Sprintf("%stype %s = %s", doc, exported, member), true
+		case *types.Const:
+			if !free(declared, exported) {
+				return "", false
+			}
+			return fmt.Sprintf("%sconst %s = %s", doc, exported, member), true
+		case *types.Func:
+			sig := o.Type().(*types.Signature)
+			if sig.TypeParams().Len() > 0 {
+				log.Warnf("weaveExposes: %s is generic, it cannot be wrapped", e.Name)
+				return "", false
+			}
+			if !free(declared, exported) {
+				return "", false
+			}
+			return doc + forwardFunc(exported, member, "", sig, qualifier), true
+		case *types.Var:
+			setter := "Set" + exported
+			if !free(declared, exported, setter) {
+				return "", false
+			}
+			t := types.TypeString(o.Type(), qualifier)
+			return fmt.Sprintf("%sfunc %s() %s {\n\treturn %s\n}\n\n// %s sets %s.\nfunc %s(v %s) {\n\t%s = v\n}",
+				doc, exported, t, member, setter, member, setter, t, member), true
+		}
+		log.Warnf("weaveExposes: %s cannot be exposed", e.Name)
+		return "", false
+	}
+
+	tn, ok := scope.Lookup(typ).(*types.TypeName)
+	if !ok {
+		log.Warnf("weaveExposes: %s: %s is not a type of: %s", e.Name, typ, pkg.Path())
+		return "", false
+	}
+	if named, ok := tn.Type().(*types.Named); ok && named.TypeParams().Len() > 0 {
+		log.Warnf("weaveExposes: %s: %s is generic, its members cannot be exposed", e.Name, typ)
+		return "", false
+	}
+	ptr := types.NewPointer(tn.Type())
+	obj, _, _ := types.LookupFieldOrMethod(ptr, true, pkg, member)
+	hasMember := func(name string) bool {
+		o, _, _ := types.LookupFieldOrMethod(ptr, true, pkg, name)
+		return o != nil
+	}
+	recv := strings.ToLower(typ[:1]) + " *" + typ
+	switch o := obj.(type) {
+	case *types.Func:
+		if !free(hasMember, exported) {
+			return "", false
+		}
+		sig := o.Type().(*types.Signature)
+		// The method's own receiver name does not clash with its parameters
+		if name := sig.Recv().Name(); name != "" && name != "_" {
+			recv = name + " *" + typ
+		}
+		return doc + forwardFunc(exported, member, recv, sig, qualifier), true
+	case *types.Var:
+		setter := "Set" + exported
+		if !free(hasMember, exported, setter) {
+			return "", false
+		}
+		r := recv[:1]
+		t := types.TypeString(o.Type(), qualifier)
+		return fmt.Sprintf("%sfunc (%s) %s() %s {\n\treturn %s.%s\n}\n\n// %s sets %s.\nfunc (%s) %s(v %s) {\n\t%s.%s = v\n}",
+			doc, recv, exported, t, r, member, setter, member, recv, setter, t, r, member), true
+	}
+	log.Warnf("weaveExposes: %s has no field or method: %s", typ, member)
+	return "", false
+}
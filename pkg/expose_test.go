@@ -0,0 +1,75 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+)
+
+// exposeTarget has an unexported declaration of every kind expose weaves reach
+const exposeTarget = `package target
+
+type Client struct{ timeout int }
+
+type conn struct{}
+
+const limit = 3
+
+var count int
+
+func dial(addr string) (*conn, error) { return &conn{}, nil }
+
+func (c *Client) reset(n int) { c.timeout = n }
+`
+
+func TestWeaveExpose(t *testing.T) {
+	tests := []struct {
+		name   string
+		expose string
+		want   []string
+	}{
+		{
+			name:   "function wrapper",
+			expose: "dial",
+			want:   []string{"// Dial exposes dial.\n", "func Dial(addr string) (*conn, error) {\n\treturn dial(addr)\n}"},
+		},
+		{
+			name:   "method wrapper",
+			expose: "(*Client).reset",
+			want:   []string{"func (c *Client) Reset(n int) {\n\tc.reset(n)\n}"},
+		},
+		{
+			name:   "field getter and setter",
+			expose: "(*Client).timeout as Deadline",
+			want:   []string{"func (c *Client) Deadline() int {\n\treturn c.timeout\n}", "// SetDeadline sets timeout.\nfunc (c *Client) SetDeadline(v int) {\n\tc.timeout = v\n}"},
+		},
+		{
+			name:   "variable getter and setter",
+			expose: "count",
+			want:   []string{"func Count() int {\n\treturn count\n}", "func SetCount(v int) {\n\tcount = v\n}"},
+		},
+		{
+			name:   "type alias",
+			expose: "conn",
+			want:   []string{"type Conn = conn\n"},
+		},
+		{
+			name:   "constant",
+			expose: "limit",
+			want:   []string{"const Limit = limit\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			weave := "package target\n\n// +weaver expose " + tt.expose + "\n"
+			m, wp := weaveTarget(t, map[string]string{"target.go": exposeTarget}, map[string]string{"target.go": weave})
+			if s := statuses(wp); !strings.HasSuffix(s, ": applied") || strings.Count(s, ":") != 1 {
+				t.Errorf("operations: %s", s)
+			}
+			contains(t, m, exposeFile, append([]string{generatedHeader, "package target\n"}, tt.want...)...)
+			// The original declarations stay as they are
+			if !strings.Contains(m.plain["target.go"], strings.TrimPrefix(exposeTarget, "package target\n")) {
+				t.Errorf("target.go changed:\n%s", m.plain["target.go"])
+			}
+		})
+	}
+}
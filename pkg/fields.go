@@ -0,0 +1,246 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"gweaver/weave"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// edit replaces the bytes start to end of the original source with text
+type edit struct {
+	start, end int
+	text       []byte
+}
+
+// weaveFields applies the field operations of weave w to struct type ts of declaration decl, or its method
+// operations to interface type ts. The changes are kept as edits of the original source of decl so the fields and
+// comments the weave does not touch keep their bytes.
+func (p *source) weaveFields(decl ast.Node, ts *ast.TypeSpec, ops []*weave.FieldOp, w *weave.Weave) {
+	var list *ast.FieldList
+	switch t := ts.Type.(type) {
+	case *ast.StructType:
+		list = t.Fields
+	case *ast.InterfaceType:
+		list = t.Methods
+		defer p.checkImplementers(ts, ops, w)
+	default:
+		log.Warnf("weaveFields: %s is neither a struct nor an interface, its field weaves are not applied", ts.Name.Name)
+		return
+	}
+	tf := p.pkg.Fset.File(ts.Pos())
+	src, err := ioutil.ReadFile(tf.Name())
+	if err != nil {
+		log.Errorf("weaveFields: error reading: %s err: %+v", tf.Name(), err)
+		return
+	}
+	off := func(pos token.Pos) int { return tf.Offset(pos) }
+	byName := make(map[string]*ast.Field)
+	for _, f := range list.List {
+		for _, n := range f.Names {
+			byName[n.Name] = f
+		}
+		if len(f.Names) == 0 {
+			byName[weave.FieldName(f)] = f
+		}
+	}
+	// Fields alone on their lines are edited line by line, gofmt realigns them
+	multiline := tf.Line(list.Opening) != tf.Line(list.Closing)
+
+	var edits []edit
+	for _, fo := range ops {
+		var e edit
+		f := byName[fo.Field]
+		switch fo.Op {
+		case "insert":
+			text := fo.Print()
+			switch {
+			case fo.Where == "first":
+				e.start = off(list.Opening) + 1
+				e.text = append([]byte("\n"), text...)
+			case fo.Where != "" && byName[fo.Anchor] == nil:
+				log.Warnf("weaveFields: %s has no field: %s to insert: %s %s", ts.Name.Name, fo.Anchor, fo.Field, fo.Where)
+				continue
+			case fo.Where == "after":
+				e.start = lineEnd(src, off(byName[fo.Anchor].End()))
+				e.text = append([]byte("\n"), text...)
+			case fo.Where == "before":
+				e.start = off(fieldStart(byName[fo.Anchor]))
+				e.text = append(text, '\n')
+			case multiline:
+				e.start = off(list.Closing)
+				e.text = append(text, '\n')
+			default:
+				e.start = off(list.Closing)
+				e.text = append(append([]byte("\n"), text...), '\n')
+			}
+			e.end = e.start
+		case "delete", "type", "tag":
+			if f == nil {
+				log.Warnf("weaveFields: %s has no field: %s to %s", ts.Name.Name, fo.Field, fo.Op)
+				continue
+			}
+			if len(f.Names) > 1 {
+				log.Warnf("weaveFields: %s.%s is declared along with other fields, it is left alone", ts.Name.Name, fo.Field)
+				continue
+			}
+			switch fo.Op {
+			case "delete":
+				e.start, e.end = off(fieldStart(f)), lineEnd(src, off(f.End()))
+				if multiline {
+					e.start = bytes.LastIndexByte(src[:e.start], '\n')
+				} else if rest := bytes.TrimLeft(src[e.end:], " \t"); len(rest) > 0 && rest[0] == ';' {
+					e.end = len(src) - len(rest) + 1
+				}
+			case "type":
+				e.start, e.end, e.text = off(f.Type.Pos()), off(f.Type.End()), fo.Type()
+			case "tag":
+				original := ""
+				e.start, e.end = off(f.Type.End()), off(f.Type.End())
+				if f.Tag != nil {
+					original = f.Tag.Value
+					e.start, e.end = off(f.Tag.Pos()), off(f.Tag.End())
+				}
+				tag, err := fo.Tag(original)
+				if err != nil {
+					log.Warnf("weaveFields: %s.%s: %+v", ts.Name.Name, fo.Field, err)
+					continue
+				}
+				if tag != "" {
+					tag = " " + tag
+				}
+				e.text = []byte(tag)
+			}
+		}
+		edits = append(edits, e)
+		fo.Applied()
+	}
+	if len(edits) > 0 {
+		p.edits[decl] = append(p.edits[decl], edits...)
+	}
+}
+
+// fieldStart is where a field starts including its doc comment
+func fieldStart(f *ast.Field) token.Pos {
+	if f.Doc != nil {
+		return f.Doc.Pos()
+	}
+	return f.Pos()
+}
+
+// applyEdits applies edits to the bytes start to end of src, edits at the same offset are applied in order and
+// overlapping ones are dropped
+func applyEdits(src []byte, start int, end int, edits []edit) []byte {
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].start < edits[j].start })
+	var out bytes.Buffer
+	at := start
+	for _, e := range edits {
+		if e.start < at {
+			log.Warnf("applyEdits: overlapping changes at offset: %d, dropping one", e.start)
+			continue
+		}
+		out.Write(src[at:e.start])
+		out.Write(e.text)
+		at = e.end
+	}
+	out.Write(src[at:end])
+	return out.Bytes()
+}
+
+// checkImplementers reports the types of the package that implement interface ts but lack a method weave w adds to
+// it or have one whose signature it changes, they would stop implementing it, and the calls of the methods it
+// removes. When the weave asks for stubs the types get stub methods panicking when called.
+func (p *source) checkImplementers(ts *ast.TypeSpec, ops []*weave.FieldOp, w *weave.Weave) {
+	if p.info == nil || p.types == nil {
+		log.Warnf("checkImplementers: %s: no type information, its implementers are not checked", ts.Name.Name)
+		return
+	}
+	obj, ok := p.info.Defs[ts.Name].(*types.TypeName)
+	if !ok {
+		return
+	}
+	iface, ok := obj.Type().Underlying().(*types.Interface)
+	if !ok {
+		return
+	}
+	qualifier := types.RelativeTo(p.types)
+
+	var added, changed []*weave.FieldOp
+	for _, fo := range ops {
+		switch {
+		case fo.Op == "insert" && fo.Method():
+			added = append(added, fo)
+		case fo.Op == "type" && fo.Method():
+			changed = append(changed, fo)
+		case fo.Op == "delete":
+			for i := 0; i < iface.NumMethods(); i++ {
+				m := iface.Method(i)
+				if m.Name() != fo.Field {
+					continue
+				}
+				for id, sel := range p.info.Selections {
+					if sel.Obj() == m {
+						log.Warnf("checkImplementers: %s: %s.%s is removed but still called", p.pkg.Fset.Position(id.Pos()), ts.Name.Name, fo.Field)
+					}
+				}
+			}
+		}
+	}
+	if len(added) == 0 && len(changed) == 0 {
+		return
+	}
+
+	scope := p.types.Scope()
+	for _, name := range scope.Names() {
+		tn, ok := scope.Lookup(name).(*types.TypeName)
+		if !ok || tn == obj || tn.IsAlias() {
+			continue
+		}
+		named, ok := tn.Type().(*types.Named)
+		if !ok || types.IsInterface(named) || named.TypeParams().Len() > 0 {
+			continue
+		}
+		var recv types.Type = named
+		if !types.Implements(recv, iface) {
+			if recv = types.NewPointer(named); !types.Implements(recv, iface) {
+				continue
+			}
+		}
+		for _, fo := range changed {
+			log.Warnf("checkImplementers: %s would stop implementing %s unless its method: %s changes to: %s", types.TypeString(recv, qualifier), ts.Name.Name, fo.Field, fo.Type())
+		}
+		for _, fo := range added {
+			if m, _, _ := types.LookupFieldOrMethod(recv, true, p.types, fo.Field); m != nil {
+				if _, ok := m.(*types.Func); ok {
+					log.Debugf("checkImplementers: %s has a method: %s, its signature is not checked against: %s", types.TypeString(recv, qualifier), fo.Field, fo.Type())
+					continue
+				}
+			}
+			if !w.Stubs(ts.Name.Name) {
+				log.Warnf("checkImplementers: %s would stop implementing %s, it has no method: %s", types.TypeString(recv, qualifier), ts.Name.Name, fo.Field)
+				continue
+			}
+			log.Infof("checkImplementers: %s gets a stub of: %s to keep implementing %s", types.TypeString(recv, qualifier), fo.Field, ts.Name.Name)
+			p.stub(types.TypeString(recv, qualifier), ts.Name.Name, fo)
+		}
+	}
+}
+
+// stub generates a method for receiver type recv panicking when called
+func (p *source) stub(recv string, iface string, fo *weave.FieldOp) {
+	method := recv + "." + fo.Field
+	if strings.HasPrefix(recv, "*") {
+		method = "(" + recv + ")." + fo.Field
+	}
+	text := fmt.Sprintf("// %s is a stub keeping %s an implementation of %s, calling it panics\nfunc (%s) %s%s {\n\tpanic(%q)\n}",
+		fo.Field, strings.TrimPrefix(recv, "*"), iface, recv, fo.Field, fo.Type(), "gweaver: stub: "+method+" is not implemented")
+	d := &ast.FuncDecl{Name: ast.NewIdent(fo.Field), Type: &ast.FuncType{}}
+	p.generated[d] = generatedDecl{op: "stub", text: []byte(text)}
+	p.appended = append(p.appended, d)
+}
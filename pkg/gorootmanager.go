@@ -0,0 +1,206 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"gweaver/weave"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// GoRootManager weaves standard library packages and the packages of the main module, which cannot be forked either.
+// Neither GOROOT nor the main module is modified, the woven files go to writeRoot and an overlay maps the originals
+// to them, build with go build -overlay writeRoot/overlay.json.
+// The target version weaves are checked against is the Go toolchain's, go1.21.3 is v1.21.3, the main module has none.
+type GoRootManager struct {
+	writeRoot string
+	goRoot    string
+	goVersion string
+	// mainModule and mainDir are the path and directory of the main module
+	mainModule string
+	mainDir    string
+	// main is set while a package of the main module is woven
+	main bool
+	// replace maps the files that were woven to their woven copies, it is the overlay's Replace
+	replace  map[string]string
+	manifest *manifest
+}
+
+func NewGoRootManager(writeRoot string) (m *GoRootManager) {
+	m = &GoRootManager{writeRoot: writeRoot, replace: make(map[string]string)}
+	m.goRoot = goEnv("GOROOT")
+	m.goVersion = goEnv("GOVERSION")
+	m.mainModule, m.mainDir = MainModule()
+	if err := os.MkdirAll(writeRoot, os.ModePerm); err != nil {
+		log.Fatalf("gorootmanager.NewGoRootManager: error creating: %s err: %+v", writeRoot, err)
+	}
+	// A go.mod of its own keeps the woven copies out of the main module's ./... patterns
+	if err := ioutil.WriteFile(filepath.Join(writeRoot, "go.mod"), []byte("module gweaver-woven\n"), 0644); err != nil {
+		log.Errorf("gorootmanager.NewGoRootManager: error writing go.mod in: %s err: %+v", writeRoot, err)
+	}
+	m.manifest = &manifest{Generator: "gweaver " + Version, Module: "std", Version: m.goVersion}
+	return
+}
+
+// InModule reports whether package path p belongs to module mod, ignoring nested modules
+func InModule(p string, mod string) bool {
+	return mod != "" && (p == mod || strings.HasPrefix(p, mod+"/"))
+}
+
+// ModulePackages lists the packages of module mod, those of nested modules are not part of it
+func ModulePackages(mod string) (pkgs []string) {
+	cmd := exec.Command("go", "list", mod+"/...")
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		log.Errorf("ModulePackages: go list %s/... failed with %s", mod, err)
+		return
+	}
+	return strings.Fields(stdout.String())
+}
+
+func (m *GoRootManager) setup(s *source) {
+	m.main = InModule(s.pkg.PkgPath, m.mainModule)
+	log.Debugf("gorootmanager.setup: package: %s goroot: %s version: %s main module: %t", s.pkg.PkgPath, m.goRoot, m.goVersion, m.main)
+}
+
+// rel is the slash separated path of file fn under writeRoot, GOROOT files keep their path relative to GOROOT and
+// files of the main module are put under the module's path
+func (m *GoRootManager) rel(fn string) (string, bool) {
+	root, prefix := m.goRoot, ""
+	if m.main {
+		root, prefix = m.mainDir, m.mainModule
+	}
+	rel, err := filepath.Rel(root, fn)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		log.Errorf("gorootmanager.rel: %s is not in: %s", fn, root)
+		return "", false
+	}
+	return path.Join(prefix, filepath.ToSlash(rel)), true
+}
+
+// woven is where the woven copy of file fn goes
+func (m *GoRootManager) woven(fn string) (string, bool) {
+	rel, ok := m.rel(fn)
+	if !ok {
+		return "", false
+	}
+	abs, err := filepath.Abs(filepath.Join(m.writeRoot, filepath.FromSlash(rel)))
+	if err != nil {
+		log.Errorf("gorootmanager.woven: err: %+v", err)
+		return "", false
+	}
+	return abs, true
+}
+
+// writeWovenFile writes the files the weaves changed and adds them to the overlay, unchanged files are left out
+func (m *GoRootManager) writeWovenFile(content []byte, plain []byte, fn string) {
+	original, err := ioutil.ReadFile(fn)
+	if err == nil && bytes.Equal(original, content) {
+		delete(m.replace, fn)
+		return
+	}
+	fqn, ok := m.woven(fn)
+	if !ok {
+		return
+	}
+	log.Debugf("Writing file: %s", fqn)
+	if err := os.MkdirAll(filepath.Dir(fqn), os.ModePerm); err != nil {
+		log.Errorf("gorootmanager.writeWovenFile: error creating directory for: %s err: %+v", fqn, err)
+		return
+	}
+	if err := ioutil.WriteFile(fqn, content, 0644); err != nil {
+		log.Errorf("gorootmanager.writeWovenFile: error writing file: %s err: %+v", fqn, err)
+		return
+	}
+	m.replace[fn] = fqn
+}
+
+// requireImports warns about weave imports outside the standard library, which cannot depend on modules. The main
+// module's go.mod has to require the modules its weaves import.
+func (m *GoRootManager) requireImports(imports []string) {
+	if m.main {
+		return
+	}
+	for _, i := range imports {
+		if !IsStdlib(i) {
+			log.Warnf("gorootmanager.requireImports: standard library weaves cannot import: %s", i)
+		}
+	}
+}
+
+func (m *GoRootManager) recordWoven(fn string, w *weave.Weave) {
+	rel, ok := m.rel(fn)
+	if !ok {
+		return
+	}
+	m.manifest.add(manifestFile{File: rel, Weave: filepath.ToSlash(w.Filename()), Operations: w.Report()})
+	m.manifest.write(m.writeRoot)
+}
+
+// wovenName names the woven copy under writeRoot, it is in the main module when writeRoot is
+func (m *GoRootManager) wovenName(fn string) string {
+	if fqn, ok := m.woven(fn); ok {
+		return sourceName(fqn)
+	}
+	return sourceName(fn)
+}
+
+func (m *GoRootManager) targetVersion() string {
+	if m.main {
+		return ""
+	}
+	return "v" + strings.TrimPrefix(m.goVersion, "go")
+}
+
+// moduleVersionOk checks the Go toolchain version against a weave's constraint, no constraint accepts any version
+func (m *GoRootManager) moduleVersionOk(c *weave.Constraint) bool {
+	if c == nil {
+		return true
+	}
+	if m.main {
+		log.Warnf("gorootmanager.moduleVersionOk: the main module has no version to check against: %s", c)
+		return false
+	}
+	return c.Check(m.targetVersion())
+}
+
+// Overlay is the file to pass to go build -overlay, it is empty when no standard library file was woven
+func (m *GoRootManager) Overlay() string {
+	if len(m.replace) == 0 {
+		return ""
+	}
+	return filepath.Join(m.writeRoot, "overlay.json")
+}
+
+// WriteOverlay writes the overlay mapping the woven GOROOT files to their woven copies
+func (m *GoRootManager) WriteOverlay() {
+	fn := m.Overlay()
+	if fn == "" {
+		return
+	}
+	b, err := json.MarshalIndent(struct{ Replace map[string]string }{m.replace}, "", "  ")
+	if err != nil {
+		log.Errorf("gorootmanager.WriteOverlay: error encoding overlay err: %+v", err)
+		return
+	}
+	if err := ioutil.WriteFile(fn, append(b, '\n'), 0644); err != nil {
+		log.Errorf("gorootmanager.WriteOverlay: error writing: %s err: %+v", fn, err)
+		return
+	}
+	log.Infof("gorootmanager.WriteOverlay: build with: -overlay %s", fn)
+}
+
+// Discard removes the overlay an earlier run left, the woven copies it maps to were overwritten by a run whose
+// operations were refused
+func (m *GoRootManager) Discard() {
+	fn := filepath.Join(m.writeRoot, "overlay.json")
+	if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+		log.Errorf("gorootmanager.Discard: error removing: %s err: %+v", fn, err)
+	}
+}
@@ -0,0 +1,86 @@
+package pkg
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGoRootManagerRel(t *testing.T) {
+	m := &GoRootManager{writeRoot: "/std-woven", goRoot: "/goroot", mainModule: "example.com/app", mainDir: "/src/app"}
+	tests := []struct {
+		name string
+		main bool
+		fn   string
+		// rel is the path under writeRoot, empty when fn is outside GOROOT or the main module
+		rel string
+	}{
+		{name: "GOROOT file", fn: "/goroot/src/net/http/client.go", rel: "src/net/http/client.go"},
+		{name: "file outside GOROOT", fn: "/src/app/main.go"},
+		{name: "main module file", main: true, fn: "/src/app/internal/x/x.go", rel: "example.com/app/internal/x/x.go"},
+		{name: "file outside the main module", main: true, fn: "/goroot/src/fmt/print.go"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m.main = tt.main
+			rel, ok := m.rel(tt.fn)
+			if rel != tt.rel || ok != (tt.rel != "") {
+				t.Errorf("rel: %s ok: %t want: %s", rel, ok, tt.rel)
+			}
+			woven, ok := m.woven(tt.fn)
+			if want := filepath.Join("/std-woven", filepath.FromSlash(tt.rel)); tt.rel != "" && (woven != want || !ok) {
+				t.Errorf("woven: %s ok: %t want: %s", woven, ok, want)
+			}
+		})
+	}
+}
+
+func TestGoRootManagerWriteOverlay(t *testing.T) {
+	dir := t.TempDir()
+	m := &GoRootManager{writeRoot: filepath.Join(dir, "std-woven"), goRoot: filepath.Join(dir, "goroot"), mainModule: "example.com/app", mainDir: filepath.Join(dir, "app"), replace: make(map[string]string)}
+	printFile, scanFile, xFile := filepath.Join(m.goRoot, "src", "fmt", "print.go"), filepath.Join(m.goRoot, "src", "fmt", "scan.go"), filepath.Join(m.mainDir, "internal", "x", "x.go")
+	originals := map[string]string{printFile: "package fmt\n", scanFile: "package fmt\n", xFile: "package x\n"}
+	for fn, content := range originals {
+		if err := os.MkdirAll(filepath.Dir(fn), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m.Overlay() != "" {
+		t.Errorf("overlay: %s before anything was woven", m.Overlay())
+	}
+	m.writeWovenFile([]byte("package fmt\n\nfunc woven() {}\n"), nil, printFile)
+	// Unchanged files are compiled from GOROOT
+	m.writeWovenFile([]byte("package fmt\n"), nil, scanFile)
+	m.main = true
+	m.writeWovenFile([]byte("package x\n\nfunc woven() {}\n"), nil, xFile)
+	m.WriteOverlay()
+
+	b, err := ioutil.ReadFile(filepath.Join(m.writeRoot, "overlay.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var overlay struct{ Replace map[string]string }
+	if err := json.Unmarshal(b, &overlay); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		printFile: filepath.Join(m.writeRoot, "src", "fmt", "print.go"),
+		xFile:     filepath.Join(m.writeRoot, "example.com", "app", "internal", "x", "x.go"),
+	}
+	if len(overlay.Replace) != len(want) {
+		t.Errorf("overlay: %v want: %v", overlay.Replace, want)
+	}
+	for fn, woven := range want {
+		if overlay.Replace[fn] != woven {
+			t.Errorf("overlay maps: %s to: %s want: %s", fn, overlay.Replace[fn], woven)
+		}
+		if b, err := ioutil.ReadFile(woven); err != nil || string(b) == originals[fn] {
+			t.Errorf("woven copy: %s of: %s err: %v", woven, fn, err)
+		}
+	}
+}
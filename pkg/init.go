@@ -0,0 +1,184 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go/ast"
+	"go/format"
+	"golang.org/x/tools/go/ast/astutil"
+	"gweaver/weave"
+	"path/filepath"
+	"sort"
+)
+
+// Init functions run in the order of the files presented to the compiler, which the go command sorts by name. The
+// init functions inserted first or last of the package go to files sorting before and after the usual ones.
+const (
+	initFirstFile = "00_gweaver_init.go"
+	initLastFile  = "zz_gweaver_init.go"
+)
+
+// isInit reports whether d is an init function
+func isInit(d ast.Decl) bool {
+	fd, ok := d.(*ast.FuncDecl)
+	return ok && fd.Recv == nil && fd.Name.Name == "init"
+}
+
+// weaveInits applies the init operations of weave w on file f: it inserts init functions before or after those of
+// f and replaces or deletes the init functions of f given by their index
+func (p *source) weaveInits(w *weave.Weave, f *ast.File) {
+	inits := w.Inits()
+	if len(inits) == 0 {
+		return
+	}
+	var upstream []ast.Decl
+	for _, d := range f.Decls {
+		if isInit(d) {
+			upstream = append(upstream, d)
+		}
+	}
+	// Imports only the removed init functions used are dropped
+	var used []string
+	for _, is := range f.Imports {
+		if path := pathFix(is.Path.Value); astutil.UsesImport(f, path) {
+			used = append(used, path)
+		}
+	}
+	var before, after []ast.Decl
+	replaced := make(map[ast.Decl][]ast.Decl)
+	deleted := make(map[ast.Decl]bool)
+	for _, in := range inits {
+		if in.Op == "insert" {
+			if in.Where == "" {
+				before = append(before, in.Decl)
+			} else {
+				after = append(after, in.Decl)
+			}
+			in.Matched()
+			continue
+		}
+		var candidates []ast.Decl
+		for i, d := range upstream {
+			if in.Index == 0 || in.Index == i+1 {
+				candidates = append(candidates, d)
+				in.Matched()
+			}
+		}
+		if len(candidates) != 1 {
+			if len(candidates) > 1 {
+				log.Warnf("weaveInits: %s has %d init functions, give the index of the one to %s", filepath.Base(p.pkg.Fset.Position(f.Package).Filename), len(candidates), in.Op)
+			}
+			continue
+		}
+		d := candidates[0]
+		if !in.Pinned(d) {
+			continue
+		}
+		switch in.Op {
+		case "replace":
+			p.removed = append(p.removed, d)
+			replaced[d] = []ast.Decl{in.Decl}
+		case "delete":
+			p.removed = append(p.removed, d)
+			deleted[d] = true
+		default:
+			renameAsOriginal(d, in.OriginalName())
+			p.touched[d] = true
+			replaced[d] = []ast.Decl{in.Decl, d}
+		}
+	}
+
+	// The init functions inserted before go where the weave's other inserts do, ahead of the first function
+	var decls []ast.Decl
+	inserted := false
+	for _, d := range f.Decls {
+		if _, ok := d.(*ast.FuncDecl); ok && !inserted {
+			decls = append(decls, before...)
+			inserted = true
+		}
+		switch {
+		case deleted[d]:
+		case replaced[d] != nil:
+			decls = append(decls, replaced[d]...)
+		default:
+			decls = append(decls, d)
+		}
+	}
+	if !inserted {
+		decls = append(decls, before...)
+	}
+	f.Decls = append(decls, after...)
+	if len(deleted) == 0 && len(replaced) == 0 {
+		return
+	}
+	for _, path := range used {
+		if dropUnusedImport(p.pkg.Fset, f, path) {
+			p.touchImports()
+		}
+	}
+}
+
+// weaveInitFiles generates the files holding the init functions the weaves insert first or last of the package
+func (p *source) weaveInitFiles(wp *weave.Pkg) {
+	for _, last := range []bool{false, true} {
+		inits := wp.PackageInits(last)
+		if len(inits) == 0 || len(p.pkg.GoFiles) == 0 {
+			continue
+		}
+		name := initFirstFile
+		if last {
+			name = initLastFile
+		}
+		for _, fn := range p.pkg.GoFiles {
+			switch b := filepath.Base(fn); {
+			case !last && b < name:
+				log.Warnf("weaveInitFiles: %s sorts before: %s, its init functions run first", b, name)
+			case last && b > name:
+				log.Warnf("weaveInitFiles: %s sorts after: %s, its init functions run last", b, name)
+			}
+		}
+		fn := filepath.Join(filepath.Dir(p.pkg.GoFiles[0]), name)
+
+		var b bytes.Buffer
+		b.WriteString(generatedHeader)
+		fmt.Fprintf(&b, "package %s\n\n", p.pkg.Name)
+		var weaves []*weave.Weave
+		imports := make(map[string]string)
+		var decls [][]byte
+		for _, in := range inits {
+			w := in.Weave()
+			if len(weaves) == 0 || weaves[len(weaves)-1] != w {
+				weaves = append(weaves, w)
+			}
+			// Only the imports of the weave the init function uses are needed
+			f := &ast.File{Name: ast.NewIdent(p.pkg.Name), Decls: []ast.Decl{in.Decl}, Imports: w.Imports(), Scope: ast.NewScope(nil)}
+			for _, is := range w.Imports() {
+				if astutil.UsesImport(f, pathFix(is.Path.Value)) {
+					imports[is.Path.Value] = string(w.Print(is))
+				}
+			}
+			decls = append(decls, withProvenance(w.Print(in.Decl), provenanceOf("insert", w)))
+			in.Matched()
+		}
+		var specs []string
+		for _, spec := range imports {
+			specs = append(specs, spec)
+		}
+		sort.Strings(specs)
+		for _, spec := range specs {
+			fmt.Fprintf(&b, "import %s\n", spec)
+		}
+		b.WriteString("\n")
+		b.Write(bytes.Join(decls, []byte("\n\n")))
+		src, err := format.Source(b.Bytes())
+		if err != nil {
+			log.Errorf("weaveInitFiles: %s: generated source is not valid Go, writing it unformatted err: %+v", fn, err)
+			src = b.Bytes()
+		}
+		p.mgr.writeWovenFile(src, bytes.TrimPrefix(src, []byte(generatedHeader)), fn)
+		for _, w := range weaves {
+			p.mgr.recordWoven(fn, w)
+		}
+	}
+}
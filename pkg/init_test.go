@@ -0,0 +1,139 @@
+package pkg
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"golang.org/x/tools/go/packages"
+	"gweaver/weave"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// initTarget has two init functions, each printing its number
+const initTarget = `package target
+
+import "fmt"
+
+var x = 1
+
+func init() { fmt.Println("1") }
+
+func f() {}
+
+func init() { fmt.Println("2") }
+`
+
+// declsOf describes the declarations of f: the token of a general declaration, the name of a function followed by
+// the first string its body prints
+func declsOf(f *ast.File) string {
+	var names []string
+	for _, d := range f.Decls {
+		switch t := d.(type) {
+		case *ast.GenDecl:
+			names = append(names, t.Tok.String())
+		case *ast.FuncDecl:
+			name := t.Name.Name
+			ast.Inspect(t.Body, func(n ast.Node) bool {
+				if lit, ok := n.(*ast.BasicLit); ok && lit.Kind == token.STRING && !strings.Contains(name, ":") {
+					s, _ := strconv.Unquote(lit.Value)
+					name += ":" + s
+				}
+				return true
+			})
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+func TestWeaveInits(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		weave  string
+		want   string
+	}{
+		{
+			name:  "insert before and after",
+			weave: "// +weaver insert after\nfunc init() { fmt.Println(\"A\") }\n\n// +weaver insert\nfunc init() { fmt.Println(\"B\") }\n",
+			want:  "import var init:B init:1 f init:2 init:A",
+		},
+		{
+			name:  "inserts keep the order of the weave",
+			weave: "// +weaver insert\nfunc init() { fmt.Println(\"B1\") }\n\n// +weaver insert\nfunc init() { fmt.Println(\"B2\") }\n\n// +weaver insert after\nfunc init() { fmt.Println(\"A1\") }\n\n// +weaver insert after\nfunc init() { fmt.Println(\"A2\") }\n",
+			want:  "import var init:B1 init:B2 init:1 f init:2 init:A1 init:A2",
+		},
+		{
+			name:  "replace by index",
+			weave: "// +weaver replace 2\nfunc init() { fmt.Println(\"R\") }\n",
+			want:  "import var init:1 f init:R",
+		},
+		{
+			name:  "delete by index",
+			weave: "// +weaver delete 1\nfunc init() {}\n",
+			want:  "import var f init:2",
+		},
+		{
+			name:  "replace and call the original",
+			weave: "// +weaver replaceAndCallOriginal 2\nfunc init() { fmt.Println(\"W\"); initOriginal2() }\n",
+			want:  "import var init:1 f init:W initOriginal2:2",
+		},
+		{
+			name:  "replace and call each original",
+			weave: "// +weaver replaceAndCallOriginal 1\nfunc init() { fmt.Println(\"W1\"); initOriginal1() }\n\n// +weaver replaceAndCallOriginal 2\nfunc init() { fmt.Println(\"W2\"); initOriginal2() }\n",
+			want:  "import var init:W1 initOriginal1:1 f init:W2 initOriginal2:2",
+		},
+		{
+			name:   "no index with a single init function",
+			target: "package target\n\nimport \"fmt\"\n\nfunc init() { fmt.Println(\"1\") }\n",
+			weave:  "// +weaver replace\nfunc init() { fmt.Println(\"R\") }\n",
+			want:   "import init:R",
+		},
+		{
+			name:  "no index with several init functions",
+			weave: "// +weaver replace\nfunc init() { fmt.Println(\"R\") }\n",
+			want:  "import var init:1 f init:2",
+		},
+		{
+			name:  "index out of range",
+			weave: "// +weaver delete 3\nfunc init() {}\n",
+			want:  "import var init:1 f init:2",
+		},
+		{
+			name:   "insert into a file without functions",
+			target: "package target\n\nvar x = 1\n",
+			weave:  "// +weaver insert\nfunc init() { fmt.Println(\"B\") }\n\n// +weaver insert after\nfunc init() { fmt.Println(\"A\") }\n",
+			want:   "var init:B init:A",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := tt.target
+			if target == "" {
+				target = initTarget
+			}
+			fset := token.NewFileSet()
+			f, err := parser.ParseFile(fset, "target.go", target, parser.ParseComments)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fn := filepath.Join(t.TempDir(), "target.go")
+			if err := ioutil.WriteFile(fn, []byte("package target\n\nimport \"fmt\"\n\n"+tt.weave), 0644); err != nil {
+				t.Fatal(err)
+			}
+			wp := weave.New([]string{fn})
+			wp.SetTarget("example.com/target", fset, "")
+			wp.SelectVersion(func(*weave.Constraint) bool { return true })
+
+			p := &source{pkg: &packages.Package{Fset: fset}, original: append([]ast.Decl(nil), f.Decls...), touched: make(map[ast.Node]bool)}
+			p.weaveInits(wp.GetWeaveForFile("target.go"), f)
+			if got := declsOf(f); got != tt.want {
+				t.Errorf("declarations: %s want: %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package pkg
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"gweaver/weave"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+)
+
+// manifestName is the file at the root of a fork listing the files the weaves modified
+const manifestName = "gweaver-manifest.json"
+
+type manifest struct {
+	Generator string         `json:"generator"`
+	Module    string         `json:"module"`
+	Version   string         `json:"version"`
+	Files     []manifestFile `json:"files"`
+}
+
+type manifestFile struct {
+	// File is the path of the woven file relative to the fork root
+	File       string           `json:"file"`
+	Weave      string           `json:"weave"`
+	Operations []weave.OpReport `json:"operations"`
+}
+
+// add records a woven file replacing any earlier record of it
+func (mf *manifest) add(f manifestFile) {
+	for i := range mf.Files {
+		if mf.Files[i].File == f.File {
+			mf.Files[i] = f
+			return
+		}
+	}
+	mf.Files = append(mf.Files, f)
+	sort.Slice(mf.Files, func(i, j int) bool { return mf.Files[i].File < mf.Files[j].File })
+}
+
+func (mf *manifest) write(dir string) {
+	b, err := json.MarshalIndent(mf, "", "  ")
+	if err != nil {
+		log.Errorf("manifest.write: error encoding manifest err: %+v", err)
+		return
+	}
+	fn := filepath.Join(dir, manifestName)
+	if err := ioutil.WriteFile(fn, append(b, '\n'), 0644); err != nil {
+		log.Errorf("manifest.write: error writing manifest: %s err: %+v", fn, err)
+	}
+}
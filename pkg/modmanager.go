@@ -1,15 +1,15 @@
 /*
-TODO How to deal with versions and version ranges
+Weaves declare the module versions they support with a `// +weaver version` constraint, see moduleVersionOk
 */
 package pkg
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	log "github.com/sirupsen/logrus"
-	"go/ast"
-	"go/printer"
-	"go/token"
+	"golang.org/x/mod/semver"
+	"gweaver/weave"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -27,6 +27,19 @@ type ModManager struct {
 	fsPrefix         string
 	fsFullWritePath  string
 	fsPrefixOriginal string
+	// manifests holds the manifest of each fork written so far, keyed by the fork's root directory
+	manifests map[string]*manifest
+	// patches holds the changes made to each module, keyed by the fork's root directory
+	patches map[string]*patch
+	// forks holds every module woven so far, keyed by the fork's root directory
+	forks map[string]*fork
+	// goMod is the go.mod file of the main module the forks are added to, its go.sum sits next to it
+	goMod string
+	// saved holds the main module's go.mod and go.sum as they were before the run, a missing file has no entry
+	saved map[string][]byte
+	// backups maps the root of each fork written by the run to where the fork an earlier run left was moved, empty
+	// when there was none
+	backups map[string]string
 }
 
 func (m *ModManager) init() {
@@ -59,26 +72,78 @@ func (m *ModManager) init() {
 	}
 }
 
-// Use New to accept config params
-func NewModManager(writeRoot string, tag string) (m *ModManager) {
+// Use New to accept config params. The forks are added to the main module through go.mod file goMod, empty for
+// ./go.mod, e.g. a copy passed to the go command with -modfile. The go.sum next to it is updated as well.
+func NewModManager(writeRoot string, tag string, goMod string) (m *ModManager) {
 	if !strings.HasSuffix(tag, "-") {
 		tag = "-" + tag
 	}
-	m = &ModManager{tag: tag, writeRoot: writeRoot}
+	if goMod == "" {
+		goMod = "go.mod"
+	}
+	m = &ModManager{tag: tag, writeRoot: writeRoot, manifests: make(map[string]*manifest), patches: make(map[string]*patch), forks: make(map[string]*fork), goMod: goMod, backups: make(map[string]string)}
+	m.dropReplaces()
 	m.init()
 	return m
 }
 
+// dropReplaces removes the replaces an earlier run added to go.mod, so the modules are loaded, woven and pinned from
+// their pristine versions again rather than from the forks. The run adds them back, Rollback restores them.
+func (m *ModManager) dropReplaces() {
+	m.save()
+	content, ok := m.saved[m.goMod]
+	if !ok {
+		return
+	}
+	var lines []string
+	dropped := false
+	for _, l := range strings.Split(string(content), "\n") {
+		if m.isWovenReplace(l) {
+			log.Infof("modmanager.dropReplaces: dropping: %s", strings.TrimSpace(l))
+			dropped = true
+			// The blank line the replace was added with goes too
+			if n := len(lines); n > 0 && strings.TrimSpace(lines[n-1]) == "" {
+				lines = lines[:n-1]
+			}
+			continue
+		}
+		lines = append(lines, l)
+	}
+	if !dropped {
+		return
+	}
+	if err := ioutil.WriteFile(m.goMod, []byte(strings.TrimRight(strings.Join(lines, "\n"), "\n")+"\n"), 0644); err != nil {
+		log.Fatalf("modmanager.dropReplaces: error writing: %s err: %+v", m.goMod, err)
+	}
+}
+
+// isWovenReplace reports whether go.mod line l is a replace the weaver adds, see replaceLine and replaceWithVersion
+func (m *ModManager) isWovenReplace(l string) bool {
+	f := strings.Fields(l)
+	switch {
+	case len(f) == 4 && f[0] == "replace" && f[2] == "=>":
+		// The module's directory fork
+		dir := filepath.ToSlash(f[3])
+		return strings.Contains(dir, f[1]+"@") && strings.HasSuffix(dir, m.tag)
+	case len(f) == 5 && f[0] == "replace" && f[2] == "=>" && f[3] == f[1]:
+		// The fork published to the module proxy
+		return strings.Contains(semver.Prerelease(f[4]), wovenPrerelease)
+	}
+	return false
+}
+
 // setup deals with things we can only know via source
 // As other package managers are implemented refactor this to make the common steps explicit
 func (m *ModManager) setup(s *source) {
-	m.parsePath(s.pkg.CompiledGoFiles)
+	m.parsePath(s.pkg.GoFiles)
 	log.Debugf("modmanager.set: fsPrefix: %s module: %s moduleVersion: %s package: %s", m.fsPrefix, m.modulePath, m.moduleVersion, m.fullPackagePath)
 	m.fsPrefixOriginal = m.fsPrefix
 	if m.writeRoot != "" {
 		m.fsPrefix = m.writeRoot
 	}
 	m.fsFullWritePath = filepath.Clean(m.fsPrefix + m.modulePath + "@" + m.moduleVersion + m.tag + m.fullPackagePath)
+	m.save()
+	m.backup(m.forkRoot())
 
 	// Create the result directory
 	err := os.MkdirAll(m.fsFullWritePath, os.ModePerm)
@@ -91,6 +156,11 @@ func (m *ModManager) setup(s *source) {
 	copyDir(src, dst)
 	fixPermissions(dst)
 
+	root := m.forkRoot()
+	if _, ok := m.forks[root]; !ok {
+		m.forks[root] = &fork{module: m.modulePath, version: m.moduleVersion, root: root, cache: m.fsPrefixOriginal, replace: m.replaceLine(), requires: make(map[string]string)}
+	}
+
 	// Ensure the resulting module has a go.mod file
 	m.copyOrCreateGoMod()
 
@@ -99,11 +169,13 @@ func (m *ModManager) setup(s *source) {
 	return
 }
 
-func (m *ModManager) parsePath(cgf []string) {
-	if len(cgf) <= 0 {
-		log.Fatalf("parsePath: compiledGoFiles[] is empty- unable to find woven source file directory.")
+// parsePath finds the module, version and package directory from the package's Go files, CompiledGoFiles may be in
+// the build cache
+func (m *ModManager) parsePath(goFiles []string) {
+	if len(goFiles) <= 0 {
+		log.Fatalf("parsePath: GoFiles[] is empty- unable to find woven source file directory.")
 	}
-	fqfp := filepath.Dir(cgf[0])
+	fqfp := filepath.Dir(goFiles[0])
 	log.Tracef("modmanager.parseFQFP: fqfp: %s", fqfp)
 	for m.modulePath, m.moduleVersion = range m.modules {
 		if m.modulePath == "" {
@@ -119,8 +191,6 @@ func (m *ModManager) parsePath(cgf []string) {
 			m.fullPackagePath = s[1]
 			if m.moduleVersion != "" {
 				m.fullPackagePath = strings.TrimPrefix(m.fullPackagePath, "@"+m.moduleVersion)
-				if !m.moduleVersionOk(m.modulePath, m.moduleVersion) {
-				}
 			}
 			return
 		default:
@@ -130,12 +200,24 @@ func (m *ModManager) parsePath(cgf []string) {
 	return
 }
 
-func (m *ModManager) writeWovenFile(node ast.Node, fn string, fset *token.FileSet) {
-	var buf bytes.Buffer
+// forkRoot is the root directory of the fork of the module being woven
+func (m *ModManager) forkRoot() string {
+	return filepath.Clean(m.fsPrefix + m.modulePath + "@" + m.moduleVersion + m.tag)
+}
+
+// forkFile returns the root directory of the fork and the slash separated path of file fn relative to it
+func (m *ModManager) forkFile(fn string) (root string, rel string) {
+	root = m.forkRoot()
+	rel = strings.TrimPrefix(filepath.ToSlash(filepath.Join(m.fullPackagePath, filepath.Base(fn))), "/")
+	return
+}
+
+// writeWovenFile writes a woven file to the fork, its patch is made of plain so it applies upstream as it is
+func (m *ModManager) writeWovenFile(content []byte, plain []byte, fn string) {
+	m.recordPatch(plain, fn)
 	fn = filepath.Base(fn)
 	fqn := filepath.Clean(m.fsPrefix + m.modulePath + "@" + m.moduleVersion + m.tag + m.fullPackagePath + string(filepath.Separator) + fn)
 	log.Debugf("Writing file: %s", fqn)
-	printer.Fprint(&buf, fset, node)
 
 	f, err := os.OpenFile(fqn, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
@@ -144,20 +226,85 @@ func (m *ModManager) writeWovenFile(node ast.Node, fn string, fset *token.FileSe
 	}
 
 	defer f.Close()
-	if _, err := f.Write(buf.Bytes()); err != nil {
+	if _, err := f.Write(content); err != nil {
 		log.Errorf("modmanager.writeWovenFile: error writing file: %s err: %+v", fqn, err)
 	}
 }
 
+// recordWoven adds a woven file to the manifest at the root of the fork, the manifest is rewritten every time so
+// it lists the files of all the packages woven in the module by this run
+func (m *ModManager) recordWoven(fn string, w *weave.Weave) {
+	root, rel := m.forkFile(fn)
+	mf, ok := m.manifests[root]
+	if !ok {
+		mf = &manifest{Generator: "gweaver " + Version, Module: m.modulePath, Version: m.moduleVersion}
+		m.manifests[root] = mf
+	}
+	mf.add(manifestFile{File: rel, Weave: filepath.ToSlash(w.Filename()), Operations: w.Report()})
+	mf.write(root)
+}
+
+// recordPatch diffs a woven file against the original file fn of the pristine module
+func (m *ModManager) recordPatch(content []byte, fn string) {
+	original, err := ioutil.ReadFile(fn)
+	switch {
+	case os.IsNotExist(err):
+		// A file the weaves generate, such as the one of exposed declarations, has no original
+		original = nil
+	case err != nil:
+		log.Errorf("modmanager.recordPatch: error reading original file: %s err: %+v", fn, err)
+		return
+	}
+	root, rel := m.forkFile(fn)
+	pt, ok := m.patches[root]
+	if !ok {
+		pt = &patch{module: m.modulePath, version: m.moduleVersion, files: make(map[string]string)}
+		m.patches[root] = pt
+	}
+	if bytes.Equal(original, content) {
+		delete(pt.files, rel)
+		return
+	}
+	pt.add(rel, original, content)
+}
+
+// WritePatches writes one patch per woven module to dir, each applies to the pristine module with git apply or
+// patch -p1. The go.mod of the fork is part of it, with the requirements added for the imports of the weaves.
+func (m *ModManager) WritePatches(dir string) {
+	for root, pt := range m.patches {
+		fk, ok := m.forks[root]
+		if !ok {
+			continue
+		}
+		woven, err := ioutil.ReadFile(filepath.Join(root, "go.mod"))
+		if err != nil {
+			log.Errorf("modmanager.WritePatches: error reading go.mod of: %s err: %+v", root, err)
+			continue
+		}
+		// A module without a go.mod of its own gets one in the fork
+		original, err := ioutil.ReadFile(filepath.Join(fk.cache, fk.module+"@"+fk.version, "go.mod"))
+		if err != nil {
+			original = nil
+		}
+		if !bytes.Equal(original, woven) {
+			pt.add("go.mod", original, woven)
+		}
+	}
+	writePatches(dir, m.patches)
+}
+
 func (m *ModManager) copyOrCreateGoMod() {
 	// Copy the original go.mod if it exists
 	src := filepath.Clean(m.fsPrefixOriginal + m.modulePath + "@" + m.moduleVersion + "/go.mod")
 	content, err := ioutil.ReadFile(src)
 	if err != nil {
 		// We'll assume file not found
-		content = []byte("module " + m.modulePath)
+		content = []byte("module " + m.modulePath + "\n")
 	}
 
+	// Keep the requirements added for the weaves of packages woven earlier
+	content = append(content, m.forks[m.forkRoot()].requireLines()...)
+
 	dst := filepath.Clean(m.fsPrefix + m.modulePath + "@" + m.moduleVersion + m.tag + "/go.mod")
 	err = ioutil.WriteFile(dst, content, 0644)
 	if err != nil {
@@ -165,15 +312,103 @@ func (m *ModManager) copyOrCreateGoMod() {
 	}
 }
 
+// requireImports adds the modules providing the packages imported by weaves to the fork's go.mod, at the versions
+// the main module selects, and records their checksums in the main module's go.sum
+func (m *ModManager) requireImports(imports []string) {
+	root := m.forkRoot()
+	fk := m.forks[root]
+	gomod := filepath.Join(root, "go.mod")
+	content, err := ioutil.ReadFile(gomod)
+	if err != nil {
+		log.Errorf("modmanager.requireImports: error reading: %s err: %+v", gomod, err)
+		return
+	}
+	for _, i := range imports {
+		mod := m.moduleOf(i)
+		if mod == "" {
+			if !IsStdlib(i) {
+				log.Warnf("modmanager.requireImports: import: %s is not provided by any module the main module requires, add it with go get", i)
+			}
+			continue
+		}
+		if mod == m.modulePath || fk.requires[mod] != "" || requires(content, mod) {
+			continue
+		}
+		version := m.modules[mod]
+		log.Infof("modmanager.requireImports: module: %s requires: %s %s for import: %s", m.modulePath, mod, version, i)
+		fk.requires[mod] = version
+		content = append(content, []byte(fmt.Sprintf("\nrequire %s %s\n", mod, version))...)
+		goModSum(m.goSum(), mod, version)
+	}
+	if err := ioutil.WriteFile(gomod, content, 0644); err != nil {
+		log.Errorf("modmanager.requireImports: error writing: %s err: %+v", gomod, err)
+	}
+}
+
+// moduleOf returns the module of the build list providing package path p, the one with the longest matching path
+func (m *ModManager) moduleOf(p string) (mod string) {
+	for mm, v := range m.modules {
+		if v == "" || len(mm) <= len(mod) {
+			continue
+		}
+		if p == mm || strings.HasPrefix(p, mm+"/") {
+			mod = mm
+		}
+	}
+	return
+}
+
+// IsStdlib reports whether an import path belongs to the standard library, whose paths have no dot in the first element
+func IsStdlib(p string) bool {
+	return !strings.Contains(strings.SplitN(p, "/", 2)[0], ".")
+}
+
+// requires reports whether a go.mod already requires module mod
+func requires(gomod []byte, mod string) bool {
+	for _, l := range strings.Split(string(gomod), "\n") {
+		f := strings.Fields(strings.TrimPrefix(strings.TrimSpace(l), "require"))
+		if len(f) >= 2 && f[0] == mod {
+			return true
+		}
+	}
+	return false
+}
+
+// goModSum downloads a module and adds its checksums to the go.sum file goSum
+func goModSum(goSum string, mod string, version string) {
+	cmd := exec.Command("go", "mod", "download", "-json", mod+"@"+version)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		log.Errorf("goModSum: go mod download: %s@%s err: %+v", mod, version, err)
+		return
+	}
+	var d struct{ Sum, GoModSum string }
+	if err := json.Unmarshal(stdout.Bytes(), &d); err != nil {
+		log.Errorf("goModSum: unexpected go mod download output: %s err: %+v", stdout.String(), err)
+		return
+	}
+	if d.Sum != "" {
+		if err := appendLine(goSum, fmt.Sprintf("%s %s %s", mod, version, d.Sum)); err != nil {
+			log.Errorf("goModSum: error updating go.sum err: %+v", err)
+		}
+	}
+	if d.GoModSum != "" {
+		if err := appendLine(goSum, fmt.Sprintf("%s %s/go.mod %s", mod, version, d.GoModSum)); err != nil {
+			log.Errorf("goModSum: error updating go.sum err: %+v", err)
+		}
+	}
+}
+
 func (m *ModManager) updateLocalGoMod() {
 	//replace github.com/davecgh/go-spew => /Users/mike/go/pkg/mod/github.com/davecgh/go-spew@v1.1.1-woven
-	f, err := os.OpenFile("go.mod", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	f, err := os.OpenFile(m.goMod, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		log.Errorf("modmanager.updateLocalGoMod: unable to open local go.mod file: %+v", err)
 		return
 	}
-	line := fmt.Sprintf("replace %s => %s%s@%s%s", m.modulePath, m.fsPrefix, m.modulePath, m.moduleVersion, m.tag)
-	if fileContains("go.mod", line) {
+	line := m.replaceLine()
+	if fileContains(m.goMod, line) {
 		return
 	}
 	defer f.Close()
@@ -182,7 +417,119 @@ func (m *ModManager) updateLocalGoMod() {
 	}
 }
 
-// TODO implement module version check
-func (m *ModManager) moduleVersionOk(module string, version string) (ok bool) {
-	return true
+// save keeps the main module's go.mod and go.sum before the run changes them, see Rollback
+func (m *ModManager) save() {
+	if m.saved != nil {
+		return
+	}
+	m.saved = make(map[string][]byte)
+	for _, fn := range []string{m.goMod, m.goSum()} {
+		if content, err := ioutil.ReadFile(fn); err == nil {
+			m.saved[fn] = content
+		}
+	}
+}
+
+// backup moves aside the fork an earlier run left at root before it is written again, see Rollback
+func (m *ModManager) backup(root string) {
+	if _, ok := m.backups[root]; ok {
+		return
+	}
+	m.backups[root] = ""
+	if _, err := os.Stat(root); err != nil {
+		return
+	}
+	old := root + ".gweaver-old"
+	removeDir(old)
+	if err := os.Rename(root, old); err != nil {
+		log.Fatalf("modmanager.backup: error moving aside: %s err: %+v", root, err)
+	}
+	m.backups[root] = old
+}
+
+// Rollback undoes the run: the forks it wrote are removed, those earlier runs left are put back and the main
+// module's go.mod and go.sum are restored. Nothing is left half woven when operations were refused.
+func (m *ModManager) Rollback() {
+	for root, old := range m.backups {
+		removeDir(root)
+		if old == "" {
+			continue
+		}
+		if err := os.Rename(old, root); err != nil {
+			log.Errorf("modmanager.Rollback: error restoring: %s err: %+v", root, err)
+		}
+	}
+	if m.saved == nil {
+		return
+	}
+	for _, fn := range []string{m.goMod, m.goSum()} {
+		content, ok := m.saved[fn]
+		var err error
+		if ok {
+			err = ioutil.WriteFile(fn, content, 0644)
+		} else if err = os.Remove(fn); os.IsNotExist(err) {
+			err = nil
+		}
+		if err != nil {
+			log.Errorf("modmanager.Rollback: error restoring: %s err: %+v", fn, err)
+		}
+	}
+}
+
+// Commit drops the forks of earlier runs moved aside, the run's forks replace them
+func (m *ModManager) Commit() {
+	for _, old := range m.backups {
+		if old != "" {
+			removeDir(old)
+		}
+	}
+}
+
+// removeDir removes a directory copied from the read only module cache
+func removeDir(dir string) {
+	if _, err := os.Stat(dir); err != nil {
+		return
+	}
+	fixPermissions(dir)
+	if err := os.RemoveAll(dir); err != nil {
+		log.Errorf("removeDir: error removing: %s err: %+v", dir, err)
+	}
+}
+
+// goSum is the go.sum file that goes with the main module's go.mod
+func (m *ModManager) goSum() string {
+	return strings.TrimSuffix(m.goMod, ".mod") + ".sum"
+}
+
+// replaceLine is the line of the local go.mod pointing the module at its fork
+func (m *ModManager) replaceLine() string {
+	return fmt.Sprintf("replace %s => %s%s@%s%s", m.modulePath, m.fsPrefix, m.modulePath, m.moduleVersion, m.tag)
+}
+
+// wovenName names the file of the fork, with TrimPath like sourceName names the files of the module cache
+func (m *ModManager) wovenName(fn string) string {
+	root, rel := m.forkFile(fn)
+	if TrimPath {
+		return m.modulePath + "@" + m.moduleVersion + m.tag + "/" + rel
+	}
+	return sourceName(filepath.Join(root, filepath.FromSlash(rel)))
+}
+
+func (m *ModManager) targetVersion() string {
+	return m.moduleVersion
+}
+
+// moduleVersionOk checks the version of the module being woven against a weave's constraint, no constraint accepts
+// any version
+func (m *ModManager) moduleVersionOk(c *weave.Constraint) (ok bool) {
+	if c == nil {
+		return true
+	}
+	if m.moduleVersion == "" {
+		log.Warnf("modmanager.moduleVersionOk: module: %s has no version to check against: %s", m.modulePath, c)
+		return false
+	}
+	ok = c.Check(m.moduleVersion)
+	log.Debugf("modmanager.moduleVersionOk: module: %s version: %s constraint: %s ok: %t", m.modulePath, m.moduleVersion, c, ok)
+	return
 }
@@ -0,0 +1,99 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDropReplaces(t *testing.T) {
+	goMod := "module " + testModule + "\n\ngo 1.21\n\nreplace example.com/local => ../local\n" +
+		"\nreplace example.com/dep => /forks/example.com/dep@v1.2.0-woven\n" +
+		"\nreplace example.com/pub => example.com/pub v1.0.0-gweaver-56f487a43920\n" +
+		"\nreplace example.com/other => /forks/example.com/other@v1.0.0-patched\n"
+	writeModule(t, map[string]string{"local/go.mod": "module example.com/local\n"})
+	if err := ioutil.WriteFile("go.mod", []byte(goMod), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := NewModManager("", "woven", "")
+	want := "module " + testModule + "\n\ngo 1.21\n\nreplace example.com/local => ../local\n" +
+		"\nreplace example.com/other => /forks/example.com/other@v1.0.0-patched\n"
+	if b, _ := ioutil.ReadFile("go.mod"); string(b) != want {
+		t.Errorf("go.mod:\n%s\nwant:\n%s", b, want)
+	}
+	m.Rollback()
+	if b, _ := ioutil.ReadFile("go.mod"); string(b) != goMod {
+		t.Errorf("go.mod after Rollback:\n%s\nwant:\n%s", b, goMod)
+	}
+}
+
+func TestRequires(t *testing.T) {
+	gomod := []byte("module example.com/dep\n\n// require example.com/comment v1.0.0\n\nrequire example.com/single v1.0.0\n\nrequire (\n\texample.com/block v1.1.0\n\texample.com/indirect v1.2.0 // indirect\n)\n\nreplace example.com/replaced => ../replaced\n")
+	for mod, want := range map[string]bool{
+		"example.com/single":   true,
+		"example.com/block":    true,
+		"example.com/indirect": true,
+		"example.com/comment":  false,
+		"example.com/replaced": false,
+		"example.com/sing":     false,
+		"example.com/dep":      false,
+	} {
+		if got := requires(gomod, mod); got != want {
+			t.Errorf("requires: %s: %t want: %t", mod, got, want)
+		}
+	}
+}
+
+func TestModuleOf(t *testing.T) {
+	m := &ModManager{modules: map[string]string{testModule: "", "example.com/a": "v1.0.0", "example.com/a/b": "v2.0.0", "example.com/ab": "v3.0.0"}}
+	for p, want := range map[string]string{
+		"example.com/a":         "example.com/a",
+		"example.com/a/x":       "example.com/a",
+		"example.com/a/b/c":     "example.com/a/b",
+		"example.com/ab/c":      "example.com/ab",
+		"example.com/abc":       "",
+		testModule + "/sub":     "",
+		"github.com/unknown/pk": "",
+	} {
+		if got := m.moduleOf(p); got != want {
+			t.Errorf("moduleOf: %s: %s want: %s", p, got, want)
+		}
+	}
+}
+
+func TestRequireImports(t *testing.T) {
+	dir := writeModule(t, map[string]string{})
+	const mod, version = "example.com/dep", "v1.2.3"
+	// The build list of the main module, logrus is in the module cache as gweaver requires it
+	modules := map[string]string{testModule: "", mod: version, "example.com/required": "v1.0.0", "github.com/sirupsen/logrus": "v1.4.2"}
+	m := &ModManager{tag: "-woven", modules: modules, modulePath: mod, moduleVersion: version, fsPrefix: dir + string(filepath.Separator), forks: make(map[string]*fork), goMod: "go.mod"}
+	root := m.forkRoot()
+	m.forks[root] = &fork{module: mod, version: version, root: root, requires: make(map[string]string)}
+	original := "module " + mod + "\n\nrequire example.com/required v0.9.0\n"
+	if err := os.MkdirAll(root, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "go.mod"), []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Only logrus is missing: the others are the standard library, the module itself, one it requires already, the
+	// main module and one outside the build list
+	m.requireImports([]string{"fmt", mod + "/internal", "example.com/required/x", "github.com/sirupsen/logrus", testModule + "/util", "example.com/unknown"})
+	m.requireImports([]string{"github.com/sirupsen/logrus/hooks/test"})
+	want := original + "\nrequire github.com/sirupsen/logrus v1.4.2\n"
+	if b, _ := ioutil.ReadFile(filepath.Join(root, "go.mod")); string(b) != want {
+		t.Errorf("go.mod:\n%s\nwant:\n%s", b, want)
+	}
+	if v := m.forks[root].requires["github.com/sirupsen/logrus"]; len(m.forks[root].requires) != 1 || v != "v1.4.2" {
+		t.Errorf("requires: %v", m.forks[root].requires)
+	}
+	// Forks of the module written later keep the requirement
+	if lines := string(m.forks[root].requireLines()); lines != "\nrequire github.com/sirupsen/logrus v1.4.2\n" {
+		t.Errorf("requireLines: %q", lines)
+	}
+	if b, _ := ioutil.ReadFile("go.sum"); !strings.Contains(string(b), "github.com/sirupsen/logrus v1.4.2/go.mod h1:") {
+		t.Errorf("go.sum has no checksum of logrus:\n%s", b)
+	}
+}
@@ -1,20 +1,33 @@
 package pkg
 
 import (
+	"bytes"
 	log "github.com/sirupsen/logrus"
-	"go/ast"
-	"go/token"
+	"gweaver/weave"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 )
 
 type PackageManager interface {
 	setup(s *source)
-	writeWovenFile(node ast.Node, fn string, fset *token.FileSet)
+	// writeWovenFile writes the woven content of file fn, plain is the content without the generated header and the
+	// //line directives
+	writeWovenFile(content []byte, plain []byte, fn string)
+	// requireImports makes the modules providing the packages imported by weaves available to the woven package
+	requireImports(imports []string)
+	// recordWoven lists a file a weave was applied to in the fork's manifest
+	recordWoven(fn string, w *weave.Weave)
+	// targetVersion is the version of the package being woven, empty if it is unknown
+	targetVersion() string
+	// moduleVersionOk reports whether the package being woven satisfies a weave's version constraint
+	moduleVersionOk(c *weave.Constraint) bool
+	// wovenName is the name //line directives give the woven copy of file fn, see sourceName
+	wovenName(fn string) string
 }
 
 func CreateDirIfNotExist(dir string) {
@@ -85,3 +98,43 @@ func fileContains(file string, query string) (ok bool) {
 	// //check whether s contains substring text
 	return strings.Contains(s, query)
 }
+
+// MainModule returns the path and directory of the main module, both are empty outside of a module
+func MainModule() (path string, dir string) {
+	cmd := exec.Command("go", "list", "-m", "-f", "{{.Path}} {{.Dir}}")
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		log.Debugf("MainModule: go list -m failed with %s", err)
+		return
+	}
+	// A workspace lists each of its modules, the first one is taken
+	line := strings.SplitN(strings.TrimSpace(stdout.String()), "\n", 2)[0]
+	if i := strings.IndexByte(line, ' '); i > 0 {
+		path, dir = line[:i], line[i+1:]
+	}
+	return
+}
+
+// goEnvs caches the go env variables read so far, they do not change while weaver runs
+var goEnvs = struct {
+	sync.Mutex
+	values map[string]string
+}{values: make(map[string]string)}
+
+// goEnv returns the value of a go env variable, go env only runs the first time a variable is read
+func goEnv(name string) string {
+	goEnvs.Lock()
+	defer goEnvs.Unlock()
+	if v, ok := goEnvs.values[name]; ok {
+		return v
+	}
+	cmd := exec.Command("go", "env", name)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		log.Fatalf("goEnv: go env %s failed with %s", name, err)
+	}
+	goEnvs.values[name] = strings.TrimSpace(stdout.String())
+	return goEnvs.values[name]
+}
@@ -0,0 +1,68 @@
+package pkg
+
+import (
+	log "github.com/sirupsen/logrus"
+	"gweaver/diff"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// patch holds the changes the weaves made to one module, keyed by the path of each file relative to the module root
+type patch struct {
+	module  string
+	version string
+	files   map[string]string
+}
+
+// add records the changes to file rel, a nil original is a file the weaves created
+func (pt *patch) add(rel string, original []byte, woven []byte) {
+	from, header := "a/"+rel, ""
+	if original == nil {
+		from, header = "/dev/null", "new file mode 100644\n"
+	}
+	d := diff.Unified(from, "b/"+rel, string(original), string(woven))
+	if d == "" {
+		delete(pt.files, rel)
+		return
+	}
+	pt.files[rel] = "diff --git a/" + rel + " b/" + rel + "\n" + header + d
+}
+
+// name is the patch's file name, module@version.patch with the module path flattened
+func (pt *patch) name() string {
+	return strings.ReplaceAll(pt.module, "/", "_") + "@" + pt.version + ".patch"
+}
+
+// bytes returns the patch in the format of git diff, it applies to the pristine module with git apply or patch -p1
+func (pt *patch) bytes() []byte {
+	var rels []string
+	for rel := range pt.files {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+	var sb strings.Builder
+	for _, rel := range rels {
+		sb.WriteString(pt.files[rel])
+	}
+	return []byte(sb.String())
+}
+
+func writePatches(dir string, patches map[string]*patch) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		log.Errorf("writePatches: error creating patch directory: %s err: %+v", dir, err)
+		return
+	}
+	for _, pt := range patches {
+		if len(pt.files) == 0 {
+			continue
+		}
+		fn := filepath.Join(dir, pt.name())
+		log.Debugf("writePatches: writing: %s", fn)
+		if err := ioutil.WriteFile(fn, pt.bytes(), 0644); err != nil {
+			log.Errorf("writePatches: error writing patch: %s err: %+v", fn, err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestPatchApply(t *testing.T) {
+	originals := map[string]string{
+		"go.mod":       "module example.com/dep\n\ngo 1.21\n",
+		"dep.go":       "package dep\n\nimport \"fmt\"\n\nfunc A() { fmt.Println(\"a\") }\n\nfunc B() {}\n\nfunc C() {}\n\nfunc D() {}\n\nfunc E() {}\n\nfunc F() { fmt.Println(\"f\") }\n",
+		"sub/sub.go":   "package sub\n\nfunc S() {}",
+		"unchanged.go": "package dep\n",
+	}
+	woven := map[string]string{
+		"go.mod":            "module example.com/dep\n\ngo 1.21\n\nrequire example.com/trace v1.0.0\n",
+		"dep.go":            "package dep\n\nimport \"fmt\"\n\nfunc A() { fmt.Println(\"woven a\") }\n\nfunc B() {}\n\nfunc C() {}\n\nfunc D() {}\n\nfunc E() {}\n\nfunc F() { fmt.Println(\"woven f\") }\n",
+		"sub/sub.go":        "package sub\n\nfunc S() { println() }\n",
+		"unchanged.go":      "package dep\n",
+		"gweaver_expose.go": "package dep\n\n// Exposed is new.\nfunc Exposed() {}\n",
+	}
+	pt := &patch{module: "example.com/dep", version: "v1.2.3", files: make(map[string]string)}
+	for rel, content := range woven {
+		var original []byte
+		if o, ok := originals[rel]; ok {
+			original = []byte(o)
+		}
+		pt.add(rel, original, []byte(content))
+	}
+	if _, ok := pt.files["unchanged.go"]; ok {
+		t.Errorf("the patch changes unchanged.go")
+	}
+	patches := t.TempDir()
+	writePatches(patches, map[string]*patch{"root": pt})
+	fn := filepath.Join(patches, "example.com_dep@v1.2.3.patch")
+
+	for _, apply := range [][]string{{"git", "apply", "--verbose"}, {"patch", "-p1", "-i"}} {
+		t.Run(apply[0], func(t *testing.T) {
+			if _, err := exec.LookPath(apply[0]); err != nil {
+				t.Skipf("%s is not installed", apply[0])
+			}
+			module := t.TempDir()
+			for rel, content := range originals {
+				fn := filepath.Join(module, filepath.FromSlash(rel))
+				if err := os.MkdirAll(filepath.Dir(fn), os.ModePerm); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cmd := exec.Command(apply[0], append(apply[1:], fn)...)
+			cmd.Dir = module
+			if out, err := cmd.CombinedOutput(); err != nil {
+				b, _ := ioutil.ReadFile(fn)
+				t.Fatalf("%v err: %v\n%s\npatch:\n%s", apply, err, out, b)
+			}
+			for rel, want := range woven {
+				b, err := ioutil.ReadFile(filepath.Join(module, filepath.FromSlash(rel)))
+				if err != nil || string(b) != want {
+					t.Errorf("%s after %v err: %v\n%s\nwant:\n%s", rel, apply, err, b, want)
+				}
+			}
+		})
+	}
+}
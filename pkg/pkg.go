@@ -1,8 +1,12 @@
 package pkg
 
 import (
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
 	"golang.org/x/tools/go/ast/astutil"
 	"golang.org/x/tools/go/packages"
 	"gweaver/weave"
@@ -11,42 +15,137 @@ import (
 	"strings"
 )
 
+// Version is the gweaver release recorded in woven files and fork manifests
+const Version = "v0.1.0"
+
 type source struct {
-	pkg             *packages.Package
+	pkg *packages.Package
+	// variants holds the package as loaded for each build context, with its external _test package when tests are
+	// loaded, pkg is the first of them
+	variants []*packages.Package
+	// contexts holds the build contexts each Go file of the package is part of
+	contexts        map[string][]BuildContext
 	isFirstFunction bool
 	mgr             PackageManager
+	// original holds the declarations of the current file before weaving
+	original []ast.Decl
+	// ends holds where each original declaration ended before weaving, its specs may be replaced or deleted since
+	ends []token.Pos
+	// touched holds the original nodes of the current file that were modified in place
+	touched map[ast.Node]bool
+	// removed holds the original nodes of the current file that were replaced or deleted, their comments go with them
+	removed []ast.Node
+	// edits holds the changes to the original source of declarations of the current file that are edited rather
+	// than printed, see weaveFields
+	edits map[ast.Node][]edit
+	// info and types are the type information of the current file and its package, nil when there is none
+	info  *types.Info
+	types *types.Package
+	// generated holds the declarations generated for the current file, such as stubs, with their source, appended
+	// lists them in order
+	generated map[ast.Decl]generatedDecl
+	appended  []ast.Decl
+	// clashes records for each rename of the package whether its new name is taken, see renameClashes
+	clashes map[*weave.Rename]bool
 }
 
-func NewPackage(p string, mgr PackageManager) (s *source) {
-	log.Tracef("NewPackage: name: %s", p)
-	//p = "./" + p
-	cfg := &packages.Config{
-		Mode:  packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles | packages.NeedImports | packages.NeedTypes | packages.NeedTypesSizes | packages.NeedSyntax | packages.NeedTypesInfo | packages.NeedDeps,
-		Tests: false,
-	}
-	//pkgs, err := packages.Load(cfg, p+"...")
-	pkgs, err := packages.Load(cfg, p)
-	if err != nil {
-		log.Fatal(err)
+// generatedDecl is the source of a declaration operation op generated
+type generatedDecl struct {
+	op   string
+	text []byte
+}
+
+// NewPackage loads package p for weaving once per build context, no context means the host's. With tests its _test.go
+// files and external _test package are loaded too.
+func NewPackage(p string, mgr PackageManager, tests bool, contexts []BuildContext) (s *source) {
+	log.Tracef("NewPackage: name: %s tests: %t contexts: %+v", p, tests, contexts)
+	if len(contexts) == 0 {
+		contexts, _ = ParseBuildContexts("", "")
 	}
+	s = &source{mgr: mgr, contexts: make(map[string][]BuildContext), clashes: make(map[*weave.Rename]bool)}
+	// All the contexts share a FileSet so positions of every variant resolve the same way
+	fset := token.NewFileSet()
+	for _, bc := range contexts {
+		//p = "./" + p
+		cfg := &packages.Config{
+			Mode:       packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles | packages.NeedImports | packages.NeedTypes | packages.NeedTypesSizes | packages.NeedSyntax | packages.NeedTypesInfo | packages.NeedDeps,
+			Tests:      tests,
+			Fset:       fset,
+			Env:        bc.env(),
+			BuildFlags: bc.buildFlags(),
+		}
+		//pkgs, err := packages.Load(cfg, p+"...")
+		pkgs, err := packages.Load(cfg, p)
+		if err != nil {
+			log.Fatal(err)
+		}
 
-	for _, p := range pkgs {
-		if p.Errors != nil {
-			log.Errorf("Error loading pkg: %s error: %+v", p.Name, p.Errors)
+		for _, p := range pkgs {
+			if p.Errors != nil {
+				log.Errorf("Error loading pkg: %s context: %s error: %+v", p.Name, bc, p.Errors)
+			}
 		}
-	}
 
-	if len(pkgs) != 1 {
-		log.Fatalf("error: %d packages found. Name: %s", len(pkgs), p)
+		var pkg, xtest *packages.Package
+		if tests {
+			for _, pp := range pkgs {
+				switch {
+				// The test variant holds the package's own files as well as its _test.go files
+				case pp.ID == p+" ["+p+".test]":
+					pkg = pp
+				case pp.ID == p && pkg == nil:
+					pkg = pp
+				case pp.PkgPath == p+"_test":
+					xtest = pp
+				}
+			}
+			if pkg == nil {
+				log.Fatalf("error: package not found. Name: %s context: %s", p, bc)
+			}
+		} else {
+			if len(pkgs) != 1 {
+				log.Fatalf("error: %d packages found. Name: %s context: %s", len(pkgs), p, bc)
+			}
+			pkg = pkgs[0]
+		}
+		for _, pp := range []*packages.Package{pkg, xtest} {
+			if pp == nil {
+				continue
+			}
+			s.variants = append(s.variants, pp)
+			for _, fn := range pp.GoFiles {
+				s.contexts[fn] = append(s.contexts[fn], bc)
+			}
+		}
+		if s.pkg == nil {
+			s.pkg = pkg
+		}
 	}
-	log.Tracef("NewPackage: pkg: %+v", pkgs[0])
+	log.Tracef("NewPackage: pkg: %+v", s.pkg)
 
-	s = &source{pkg: pkgs[0], mgr: mgr}
 	mgr.setup(s)
 	log.Debugf("NewPackage: name: %s path: %s", s.pkg.Name, s.pkg.PkgPath)
 	return s
 }
 
+// NewPackageFromFiles parses the Go files of package p as given, without the go command, for weaving them where the
+// go command already picked the files, e.g. in a compile invocation
+func NewPackageFromFiles(p string, files []string, mgr PackageManager) (s *source) {
+	log.Tracef("NewPackageFromFiles: name: %s files: %+v", p, files)
+	pkg := &packages.Package{ID: p, PkgPath: p, Fset: token.NewFileSet(), GoFiles: files, CompiledGoFiles: files}
+	for _, fn := range files {
+		f, err := parser.ParseFile(pkg.Fset, fn, nil, parser.ParseComments)
+		if err != nil {
+			log.Fatalf("NewPackageFromFiles: error parsing: %s err: %+v", fn, err)
+		}
+		pkg.Name = f.Name.Name
+		pkg.Syntax = append(pkg.Syntax, f)
+	}
+	s = &source{pkg: pkg, variants: []*packages.Package{pkg}, contexts: make(map[string][]BuildContext), mgr: mgr, clashes: make(map[*weave.Rename]bool)}
+	mgr.setup(s)
+	return s
+}
+
 func (p *source) applyWeave(w *weave.Weave, f *ast.File) ast.Node {
 	// TODO some operations should happen on the parent, delete for instance
 	// preApply & postApply go inside this method so they can capture the weave pointer
@@ -65,23 +164,35 @@ func (p *source) applyWeave(w *weave.Weave, f *ast.File) ast.Node {
 		wn, ok := w.GetReplace(c.Node())
 		if ok {
 			log.Tracef("Replace: %+v with: %+v", c.Node(), *wn)
+			p.removed = append(p.removed, c.Node())
 			c.Replace(*wn)
 		}
 
 		wn, ok = w.GetReplaceAndCallOriginal(c.Node())
 		if ok {
 			log.Tracef("ReplaceAndCallOriginal: %+v with: %+v", c.Node(), *wn)
-			renameAsOriginal(c.Node())
+			renameAsOriginal(c.Node(), w.OriginalName(c.Node()))
+			p.touched[c.Node()] = true
 			c.InsertBefore(*wn)
 		}
 
+		if ops, ok := w.GetFields(c.Node()); ok {
+			p.weaveFields(c.Parent(), c.Node().(*ast.TypeSpec), ops, w)
+		}
+
 		// See if we delete this node
 		wn, ok = w.GetDelete(c.Node())
 		if ok {
 			log.Tracef("Delete: %+v", c.Node())
+			p.removed = append(p.removed, c.Node())
 			c.Delete()
 		}
-		return true
+		// Only top-level declarations are matched, the declarations local to a function are not the weave's targets
+		switch c.Node().(type) {
+		case *ast.File, *ast.GenDecl:
+			return true
+		}
+		return false
 	}
 
 	postApply := func(c *astutil.Cursor) (ok bool) {
@@ -101,43 +212,163 @@ func (p *source) ApplyWeave(wp *weave.Pkg) {
 	log.Tracef("ApplyWeave")
 	log.Tracef("ApplyWeave: processing p: %+v", *p)
 	log.Tracef("ApplyWeave: processing p.pkg: %+v", *p.pkg)
+	wp.SetTarget(p.pkg.PkgPath, p.pkg.Fset, p.mgr.targetVersion())
+	wp.SelectVersion(p.mgr.moduleVersionOk)
 
-	// For each file's AST in the pkg
-	for fi, f := range p.pkg.Syntax {
-		log.Tracef("ApplyWeave: processing f: %+v", f)
-		// f is *ast.File but f.Name is _really_ the package name! :-(
-		w := wp.GetWeaveForFile(filepath.Base(p.pkg.CompiledGoFiles[fi]))
-		// If the weave is nil there is no weave for this file/ast, write as-is
-		if w == nil {
-			p.mgr.writeWovenFile(f, p.pkg.CompiledGoFiles[fi], p.pkg.Fset)
-			continue
-		}
-
-		for _, i := range w.ImportAdds {
-			if i.Name == nil {
-				astutil.AddImport(p.pkg.Fset, f, pathFix(i.Path.Value))
-			} else {
-				astutil.AddNamedImport(p.pkg.Fset, f, i.Name.String(), pathFix(i.Path.Value))
+	// For each file's AST in every variant of the pkg, a file in several of them is woven once
+	done := make(map[string]bool)
+	for _, pp := range p.variants {
+		for _, f := range pp.Syntax {
+			sf, fn, ok := p.sourceFile(pp, f)
+			if !ok || done[fn] {
+				continue
 			}
-		}
-		for _, i := range w.ImportDeletes {
-			if i.Name == nil {
-				astutil.DeleteImport(p.pkg.Fset, f, pathFix(i.Path.Value))
-			} else {
-				astutil.DeleteNamedImport(p.pkg.Fset, f, i.Name.String(), pathFix(i.Path.Value))
+			done[fn] = true
+			// The original source of a cgo file is parsed again, it has no type information
+			p.info, p.types = pp.TypesInfo, pp.Types
+			if sf != f {
+				p.info = nil
 			}
+			p.weaveFile(wp, sf, fn)
+		}
+	}
+	p.weaveExposes(wp.Exposes())
+	p.weaveInitFiles(wp)
+}
+
+// sourceFile pairs a syntax tree with the Go file it was parsed from. Syntax is parsed from CompiledGoFiles which,
+// for cgo packages, are generated into the build cache. Those are found through their //line directives and replaced
+// by a tree of the original source, import "C" preamble included, the cgo output never goes into the fork.
+func (p *source) sourceFile(pp *packages.Package, f *ast.File) (*ast.File, string, bool) {
+	goFiles := make(map[string]bool)
+	for _, fn := range pp.GoFiles {
+		goFiles[fn] = true
+	}
+	fn := p.pkg.Fset.File(f.Package).Name()
+	if goFiles[fn] {
+		return f, fn, true
+	}
+	orig := p.pkg.Fset.Position(f.Package).Filename
+	if !goFiles[orig] {
+		// cgo support files such as _cgo_gotypes.go have no source of their own
+		log.Debugf("sourceFile: %s is not one of the package's Go files, leaving it out", fn)
+		return nil, "", false
+	}
+	log.Debugf("sourceFile: %s was generated from: %s, weaving the original", fn, orig)
+	src, err := parser.ParseFile(p.pkg.Fset, orig, nil, parser.ParseComments)
+	if err != nil {
+		log.Errorf("sourceFile: error parsing: %s err: %+v", orig, err)
+		return nil, "", false
+	}
+	return src, orig, true
+}
+
+// weaveFile applies the weave for file fn, if any, and the package wide weaves and writes the result to the fork
+func (p *source) weaveFile(wp *weave.Pkg, f *ast.File, fn string) {
+	log.Tracef("weaveFile: processing f: %+v", f)
+	// f is *ast.File but f.Name is _really_ the package name! :-(
+	// cgo output handed to the compiler, x.cgo1.go, is woven with the weave for x.go
+	w := wp.GetWeaveForFile(strings.Replace(filepath.Base(fn), ".cgo1.go", ".go", 1))
+	if w != nil && !p.buildOk(w, fn) {
+		w = nil
+	}
+	p.original = append([]ast.Decl(nil), f.Decls...)
+	p.ends = make([]token.Pos, len(f.Decls))
+	for i, d := range f.Decls {
+		p.ends[i] = d.End()
+	}
+	p.touched = make(map[ast.Node]bool)
+	p.removed = nil
+	p.edits = make(map[ast.Node][]edit)
+	p.generated = make(map[ast.Decl]generatedDecl)
+	p.appended = nil
+	// Package wide weaves apply to every file, pw is the last one that changed this file
+	pw := p.weaveCallSites(wp.CallSites(), p.info, f)
+	if sw := p.weaveSubstitutes(wp.Substitutes(), p.info, f); sw != nil {
+		pw = sw
+	}
+	if gw := p.weaveSignatures(wp.Signatures(), p.info, f); gw != nil {
+		pw = gw
+	}
+	if rw := p.weaveRenames(wp.Renames(), p.info, f); rw != nil {
+		pw = rw
+	}
+	// If the weave is nil there is no weave for this file/ast, write as-is unless a package wide weave changed it
+	if w == nil {
+		f.Decls = append(f.Decls, p.appended...)
+		content, plain := p.render(f, pw)
+		p.mgr.writeWovenFile(content, plain, fn)
+		if pw != nil {
+			p.mgr.recordWoven(fn, pw)
+		}
+		return
+	}
+
+	var imports []string
+	for _, i := range w.ImportAdds {
+		imports = append(imports, pathFix(i.Path.Value))
+		var ok bool
+		if i.Name == nil {
+			ok = astutil.AddImport(p.pkg.Fset, f, pathFix(i.Path.Value))
+		} else {
+			ok = astutil.AddNamedImport(p.pkg.Fset, f, i.Name.String(), pathFix(i.Path.Value))
+		}
+		if ok {
+			p.touchImports()
+		}
+		// Adding an import that is already there still satisfies the weave
+		w.ImportAdded(i)
+	}
+	p.mgr.requireImports(imports)
+	for _, i := range w.ImportDeletes {
+		var ok bool
+		if i.Name == nil {
+			ok = astutil.DeleteImport(p.pkg.Fset, f, pathFix(i.Path.Value))
+		} else {
+			ok = astutil.DeleteNamedImport(p.pkg.Fset, f, i.Name.String(), pathFix(i.Path.Value))
+		}
+		if ok {
+			p.touchImports()
+			w.ImportDeleted(i)
+		}
+	}
+	log.Tracef("weaveFile: f: %+v", f)
+	// Rules apply to the original functions, before the weave replaces any of them
+	p.weaveRules(w, f)
+	p.weaveInits(w, f)
+	rewritten := p.applyWeave(w, f).(*ast.File)
+	rewritten.Decls = append(rewritten.Decls, p.appended...)
+	content, plain := p.render(rewritten, w)
+	p.mgr.writeWovenFile(content, plain, fn)
+	p.mgr.recordWoven(fn, w)
+}
+
+// buildOk reports whether the build constraint of weave w holds in every build context file fn is part of, a weave
+// for a platform specific file can so be restricted to that platform
+func (p *source) buildOk(w *weave.Weave, fn string) bool {
+	for _, bc := range p.contexts[fn] {
+		if !w.BuildOk(bc.Tag) {
+			w.Skip(fmt.Sprintf("its build constraint does not hold for: %s in: %s", filepath.Base(fn), bc))
+			return false
+		}
+	}
+	return true
+}
+
+// touchImports marks the file's import declarations as modified, astutil may have changed any of them
+func (p *source) touchImports() {
+	for _, d := range p.original {
+		if gd, ok := d.(*ast.GenDecl); ok && gd.Tok == token.IMPORT {
+			p.touched[gd] = true
 		}
-		log.Tracef("ApplyWeave: f: %+v", f)
-		rewritten := p.applyWeave(w, f)
-		p.mgr.writeWovenFile(rewritten, p.pkg.CompiledGoFiles[fi], p.pkg.Fset)
 	}
 }
 
 // Rename the original func so we can take its place
-func renameAsOriginal(node ast.Node) {
+func renameAsOriginal(node ast.Node, name string) {
 	switch t := node.(type) {
 	case *ast.FuncDecl:
-		t.Name.Name = t.Name.Name + "Original"
+		t.Name.Name = name
 	default:
 	}
 }
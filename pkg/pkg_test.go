@@ -0,0 +1,194 @@
+package pkg
+
+import (
+	"go/build"
+	"gweaver/weave"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testModule is the module the fixtures of the tests are written to
+const testModule = "example.com/target"
+
+// testManager keeps the woven files in memory, keyed by base name
+type testManager struct {
+	files   map[string]string
+	plain   map[string]string
+	imports []string
+}
+
+func newTestManager() *testManager {
+	return &testManager{files: make(map[string]string), plain: make(map[string]string)}
+}
+
+func (m *testManager) setup(s *source) {}
+
+func (m *testManager) writeWovenFile(content []byte, plain []byte, fn string) {
+	m.files[filepath.Base(fn)] = string(content)
+	m.plain[filepath.Base(fn)] = string(plain)
+}
+
+func (m *testManager) requireImports(imports []string) {
+	m.imports = append(m.imports, imports...)
+}
+
+func (m *testManager) recordWoven(fn string, w *weave.Weave) {}
+
+func (m *testManager) targetVersion() string {
+	return ""
+}
+
+func (m *testManager) moduleVersionOk(c *weave.Constraint) bool {
+	return c == nil
+}
+
+func (m *testManager) wovenName(fn string) string {
+	return sourceName(fn)
+}
+
+// writeModule writes files, keyed by slash separated path, to module testModule in a temporary directory the test
+// then runs in, weaves go under ext/<package path>/. It returns the directory.
+func writeModule(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	files["go.mod"] = "module " + testModule + "\n\ngo 1.21\n"
+	for rel, content := range files {
+		fn := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(fn), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Chdir(dir)
+	return dir
+}
+
+// weavePackage applies the weaves of ext/<p> to package p of the module writeModule wrote, callers are the signature
+// changes of other packages whose calls p makes. It returns the woven files and the weaves.
+func weavePackage(t *testing.T, p string, callers []*weave.Signature) (*testManager, *weave.Pkg) {
+	files, _ := filepath.Glob(filepath.Join("ext", filepath.FromSlash(p), "*.go"))
+	sort.Strings(files)
+	wp := weave.New(files)
+	wp.AddCallers(callers)
+	m := newTestManager()
+	s := NewPackage(p, m, wp.HasTestWeaves(), nil)
+	s.ApplyWeave(wp)
+	return m, wp
+}
+
+// weaveTarget weaves package testModule of a module of files, weaves are keyed by file name
+func weaveTarget(t *testing.T, files map[string]string, weaves map[string]string) (*testManager, *weave.Pkg) {
+	for name, content := range weaves {
+		files[path.Join("ext", testModule, name)] = content
+	}
+	writeModule(t, files)
+	return weavePackage(t, testModule, nil)
+}
+
+// statuses lists the status of each operation of wp as op name: status
+func statuses(wp *weave.Pkg) string {
+	var s []string
+	for _, o := range wp.Report() {
+		s = append(s, o.Op+" "+o.Name+": "+o.Status)
+	}
+	return strings.Join(s, ", ")
+}
+
+// contains fails the test unless woven file fn holds each of want
+func contains(t *testing.T, m *testManager, fn string, want ...string) {
+	t.Helper()
+	content, ok := m.files[fn]
+	if !ok {
+		t.Fatalf("%s was not written, files: %v", fn, m.names())
+	}
+	for _, w := range want {
+		if !strings.Contains(content, w) {
+			t.Errorf("%s:\n%s\nhas no: %s", fn, content, w)
+		}
+	}
+}
+
+// lacks fails the test if woven file fn holds any of unwanted
+func lacks(t *testing.T, m *testManager, fn string, unwanted ...string) {
+	t.Helper()
+	for _, u := range unwanted {
+		if strings.Contains(m.files[fn], u) {
+			t.Errorf("%s:\n%s\nstill has: %s", fn, m.files[fn], u)
+		}
+	}
+}
+
+func (m *testManager) names() (names []string) {
+	for fn := range m.files {
+		names = append(names, fn)
+	}
+	sort.Strings(names)
+	return
+}
+
+func TestWeaveReport(t *testing.T) {
+	target := "package target\n\ntype T int\n\ntype U int\n\nfunc (T) String() string { return \"t\" }\n\nfunc (U) String() string { return \"u\" }\n\nvar v = 1\n"
+	weave := "package target\n\n// +weaver replace\nvar v = 2\n\n// +weaver delete\nfunc g() {}\n\n// +weaver delete\nfunc String() string { return \"x\" }\n"
+	_, wp := weaveTarget(t, map[string]string{"target.go": target}, map[string]string{"target.go": weave})
+	if s, want := statuses(wp), "delete String: ambiguous, delete g: unmatched, replace v: applied"; s != want {
+		t.Errorf("operations: %s want: %s", s, want)
+	}
+	for _, o := range wp.Report() {
+		if o.Name == "String" && o.Matches != 2 {
+			t.Errorf("%s %s matched: %d times want: 2", o.Op, o.Name, o.Matches)
+		}
+	}
+}
+
+func TestWeaveCgo(t *testing.T) {
+	if !build.Default.CgoEnabled {
+		t.Skip("cgo is disabled")
+	}
+	files := map[string]string{
+		"cgo.go":   "package target\n\n// #include <stdlib.h>\nimport \"C\"\n\n// Abs calls C.\nfunc Abs(x int) int { return int(C.abs(C.int(x))) }\n\nfunc Name() string { return \"c\" }\n",
+		"plain.go": "package target\n\nfunc Plain() string { return \"p\" }\n",
+	}
+	weaves := map[string]string{
+		"cgo.go":   "package target\n\n// +weaver replace\nfunc Name() string { return \"woven\" }\n",
+		"plain.go": "package target\n\n// +weaver replace\nfunc Plain() string { return \"woven\" }\n",
+	}
+	m, wp := weaveTarget(t, files, weaves)
+	if s := statuses(wp); s != "replace Name: applied, replace Plain: applied" {
+		t.Errorf("operations: %s", s)
+	}
+	// The cgo output in the build cache, such as _cgo_gotypes.go, is never woven
+	if names := strings.Join(m.names(), " "); names != "cgo.go plain.go" {
+		t.Errorf("woven files: %s want: cgo.go plain.go", names)
+	}
+	contains(t, m, "cgo.go", "// #include <stdlib.h>\nimport \"C\"\n", "func Abs(x int) int { return int(C.abs(C.int(x))) }\n", "func Name() string { return \"woven\" }")
+	lacks(t, m, "cgo.go", "_Cfunc_", "_cgo_")
+	contains(t, m, "plain.go", "func Plain() string { return \"woven\" }")
+}
+
+func TestWeaveTests(t *testing.T) {
+	files := map[string]string{
+		"target.go":      "package target\n\nfunc Add(a, b int) int { return a + b }\n",
+		"target_test.go": "package target\n\nimport \"testing\"\n\nfunc TestAdd(t *testing.T) {\n\tif Add(1, 2) != 3 {\n\t\tt.Fail()\n\t}\n}\n\nfunc TestFlaky(t *testing.T) {}\n",
+		"x_test.go":      "package target_test\n\nimport (\n\t\"testing\"\n\n\t\"" + testModule + "\"\n)\n\nfunc TestExternal(t *testing.T) {\n\tif target.Add(2, 2) != 4 {\n\t\tt.Fail()\n\t}\n}\n",
+	}
+	weaves := map[string]string{
+		"target_test.go": "package target\n\nimport \"testing\"\n\n// +weaver delete\nfunc TestFlaky(t *testing.T) {}\n",
+		"x_test.go":      "package target_test\n\nimport \"testing\"\n\n// +weaver replace\nfunc TestExternal(t *testing.T) { t.Skip() }\n",
+	}
+	m, wp := weaveTarget(t, files, weaves)
+	if !wp.HasTestWeaves() {
+		t.Errorf("the weaves of _test.go files are not test weaves")
+	}
+	if s := statuses(wp); s != "delete TestFlaky: applied, replace TestExternal: applied" {
+		t.Errorf("operations: %s", s)
+	}
+	contains(t, m, "target_test.go", "func TestAdd(t *testing.T) {")
+	lacks(t, m, "target_test.go", "TestFlaky")
+	contains(t, m, "x_test.go", "package target_test\n", "func TestExternal(t *testing.T) { t.Skip() }")
+}
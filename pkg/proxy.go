@@ -0,0 +1,212 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	"golang.org/x/mod/sumdb/dirhash"
+	modzip "golang.org/x/mod/zip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fork is a woven copy of a module
+type fork struct {
+	module  string
+	version string
+	root    string
+	// cache is the root of the module cache the pristine module came from
+	cache string
+	// replace is the line of the local go.mod pointing the module at the fork
+	replace string
+	// requires holds the modules added to the fork's go.mod for the imports of weaves, with their versions
+	requires map[string]string
+}
+
+// requireLines are the go.mod require directives added to the fork, in a stable order
+func (fk *fork) requireLines() []byte {
+	var mods []string
+	for mod := range fk.requires {
+		mods = append(mods, mod)
+	}
+	sort.Strings(mods)
+	var b bytes.Buffer
+	for _, mod := range mods {
+		fmt.Fprintf(&b, "\nrequire %s %s\n", mod, fk.requires[mod])
+	}
+	return b.Bytes()
+}
+
+// WriteProxy packages each fork as a module of a file based GOPROXY rooted at dir, use it with GOPROXY=file://dir.
+// A fork is published under a version of its own, see wovenVersion, the local go.mod replaces the module with it
+// and go.sum gets its checksums.
+func (m *ModManager) WriteProxy(dir string) {
+	var roots []string
+	for root := range m.forks {
+		roots = append(roots, root)
+	}
+	sort.Strings(roots)
+	for _, root := range roots {
+		fk := m.forks[root]
+		if err := fk.writeProxy(dir, m.goMod, m.goSum()); err != nil {
+			log.Errorf("modmanager.WriteProxy: module: %s err: %+v", fk.module, err)
+		}
+	}
+}
+
+func (fk *fork) writeProxy(dir string, goMod string, goSum string) (err error) {
+	version, err := fk.wovenVersion()
+	if err != nil {
+		return
+	}
+	log.Infof("fork.writeProxy: module: %s version: %s", fk.module, version)
+
+	escMod, err := module.EscapePath(fk.module)
+	if err != nil {
+		return
+	}
+	escVer, err := module.EscapeVersion(version)
+	if err != nil {
+		return
+	}
+	vdir := filepath.Join(dir, filepath.FromSlash(escMod), "@v")
+	if err = os.MkdirAll(vdir, os.ModePerm); err != nil {
+		return
+	}
+
+	gomod, err := ioutil.ReadFile(filepath.Join(fk.root, "go.mod"))
+	if err != nil {
+		return
+	}
+	var zb bytes.Buffer
+	if err = modzip.CreateFromDir(&zb, module.Version{Path: fk.module, Version: version}, fk.root); err != nil {
+		return
+	}
+	info, err := json.Marshal(struct {
+		Version string
+		Time    time.Time
+	}{version, fk.originalTime()})
+	if err != nil {
+		return
+	}
+	for ext, content := range map[string][]byte{".zip": zb.Bytes(), ".mod": gomod, ".info": info} {
+		if err = ioutil.WriteFile(filepath.Join(vdir, escVer+ext), content, 0644); err != nil {
+			return
+		}
+	}
+	if err = appendLine(filepath.Join(vdir, "list"), version); err != nil {
+		return
+	}
+
+	zipHash, err := dirhash.HashZip(filepath.Join(vdir, escVer+".zip"), dirhash.Hash1)
+	if err != nil {
+		return
+	}
+	modHash, err := dirhash.Hash1([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(gomod)), nil
+	})
+	if err != nil {
+		return
+	}
+	if err = appendLine(goSum, fmt.Sprintf("%s %s %s", fk.module, version, zipHash)); err != nil {
+		return
+	}
+	if err = appendLine(goSum, fmt.Sprintf("%s %s/go.mod %s", fk.module, version, modHash)); err != nil {
+		return
+	}
+	return fk.replaceWithVersion(goMod, version)
+}
+
+// wovenVersion is the version the fork is published as, the version it was woven from with a gweaver pre-release
+// identifier holding the hash of the fork, e.g. v1.1.1 becomes v1.1.1-gweaver-<hash> and v1.2.0-rc.1 becomes
+// v1.2.0-rc.1.gweaver-<hash>. Unlike a pseudo-version it cannot be mistaken for, or collide with, one of upstream.
+func (fk *fork) wovenVersion() (string, error) {
+	if !semver.IsValid(fk.version) {
+		return "", fmt.Errorf("unable to derive a woven version from: %s", fk.version)
+	}
+	sum, err := dirhash.HashDir(fk.root, "", dirhash.Hash1)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256([]byte(sum))
+	return wovenVersion(fk.version, hex.EncodeToString(h[:])[:12]), nil
+}
+
+// wovenVersion adds the gweaver pre-release identifier with hash to version, build metadata such as +incompatible
+// is kept
+func wovenVersion(version string, hash string) string {
+	build := semver.Build(version)
+	base := strings.TrimSuffix(version, build)
+	sep := "-"
+	if semver.Prerelease(base) != "" {
+		sep = "."
+	}
+	return base + sep + wovenPrerelease + hash + build
+}
+
+// wovenPrerelease starts the pre-release identifier of the versions forks are published as
+const wovenPrerelease = "gweaver-"
+
+// originalTime is the time of the version the fork was woven from, as recorded by the module cache
+func (fk *fork) originalTime() time.Time {
+	var info struct{ Time time.Time }
+	escMod, _ := module.EscapePath(fk.module)
+	escVer, _ := module.EscapeVersion(fk.version)
+	fn := filepath.Join(fk.cache, "cache", "download", filepath.FromSlash(escMod), "@v", escVer+".info")
+	b, err := ioutil.ReadFile(fn)
+	if err == nil {
+		err = json.Unmarshal(b, &info)
+	}
+	if err != nil || info.Time.IsZero() {
+		log.Warnf("fork.originalTime: no time for module: %s version: %s using the current time err: %+v", fk.module, fk.version, err)
+		return time.Now().UTC().Truncate(time.Second)
+	}
+	return info.Time.UTC()
+}
+
+// replaceWithVersion swaps the local go.mod's directory replace of the module for one to its woven version
+func (fk *fork) replaceWithVersion(goMod string, version string) error {
+	b, err := ioutil.ReadFile(goMod)
+	if err != nil {
+		return err
+	}
+	var lines []string
+	for _, l := range strings.Split(string(b), "\n") {
+		if strings.TrimSpace(l) != fk.replace {
+			lines = append(lines, l)
+		}
+	}
+	content := strings.TrimRight(strings.Join(lines, "\n"), "\n") + "\n"
+	line := fmt.Sprintf("replace %s => %s %s", fk.module, fk.module, version)
+	if !strings.Contains(content, line) {
+		content += "\n" + line + "\n"
+	}
+	return ioutil.WriteFile(goMod, []byte(content), 0644)
+}
+
+// appendLine adds line to file fn unless it is already there
+func appendLine(fn string, line string) error {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, l := range strings.Split(string(b), "\n") {
+		if strings.TrimSpace(l) == line {
+			return nil
+		}
+	}
+	if len(b) > 0 && !bytes.HasSuffix(b, []byte("\n")) {
+		b = append(b, '\n')
+	}
+	return ioutil.WriteFile(fn, append(b, []byte(line+"\n")...), 0644)
+}
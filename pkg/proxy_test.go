@@ -0,0 +1,147 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	"golang.org/x/mod/sumdb/dirhash"
+	modzip "golang.org/x/mod/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWovenVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    string
+	}{
+		{"v1.1.1", "v1.1.1-gweaver-0123abcd"},
+		{"v1.2.0-rc.1", "v1.2.0-rc.1.gweaver-0123abcd"},
+		{"v2.0.0+incompatible", "v2.0.0-gweaver-0123abcd+incompatible"},
+		{"v0.0.0-20190101000000-abcdef123456", "v0.0.0-20190101000000-abcdef123456.gweaver-0123abcd"},
+	}
+	for _, tt := range tests {
+		got := wovenVersion(tt.version, "0123abcd")
+		if got != tt.want {
+			t.Errorf("wovenVersion(%s) = %s want: %s", tt.version, got, tt.want)
+		}
+		if !semver.IsValid(got) || module.IsPseudoVersion(got) {
+			t.Errorf("wovenVersion(%s) = %s is not a valid version or is a pseudo-version", tt.version, got)
+		}
+		if base := strings.TrimSuffix(tt.version, semver.Build(tt.version)); semver.Compare(got, base) == 0 {
+			t.Errorf("wovenVersion(%s) = %s is the original version", tt.version, got)
+		}
+	}
+}
+
+func TestWriteProxy(t *testing.T) {
+	tmp := t.TempDir()
+	root := filepath.Join(tmp, "fork")
+	files := map[string]string{
+		"go.mod":                "module example.com/Mod\n\nrequire example.com/dep v1.0.0\n",
+		"mod.go":                "package mod\n",
+		"sub/sub.go":            "package sub\n",
+		".git/HEAD":             "ref: refs/heads/main\n",
+		"nested/go.mod":         "module example.com/Mod/nested\n",
+		"nested/nested.go":      "package nested\n",
+		"gweaver-manifest.json": "{}\n",
+		"testdata/data.txt":     "data\n",
+	}
+	// The module cache records the time of the version the fork was woven from
+	cache := filepath.Join(tmp, "cache")
+	files["../cache/cache/download/example.com/!mod/@v/v1.2.3.info"] = `{"Version":"v1.2.3","Time":"2020-01-02T03:04:05Z"}`
+	for rel, content := range files {
+		fn := filepath.Join(root, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(fn), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	goMod := filepath.Join(tmp, "go.mod")
+	goSum := filepath.Join(tmp, "go.sum")
+	replace := "replace example.com/Mod => " + root
+	if err := ioutil.WriteFile(goMod, []byte("module main\n\n"+replace+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fk := &fork{module: "example.com/Mod", version: "v1.2.3", root: root, cache: cache, replace: replace}
+	dir := filepath.Join(tmp, "proxy")
+	if err := fk.writeProxy(dir, goMod, goSum); err != nil {
+		t.Fatalf("writeProxy err: %v", err)
+	}
+
+	vdir := filepath.Join(dir, "example.com", "!mod", "@v")
+	list, err := ioutil.ReadFile(filepath.Join(vdir, "list"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := strings.TrimSpace(string(list))
+	if !strings.HasPrefix(version, "v1.2.3-gweaver-") {
+		t.Fatalf("version: %s want: v1.2.3-gweaver-<hash>", version)
+	}
+	m := module.Version{Path: fk.module, Version: version}
+
+	var info struct{ Version, Time string }
+	b, err := ioutil.ReadFile(filepath.Join(vdir, version+".info"))
+	if err == nil {
+		err = json.Unmarshal(b, &info)
+	}
+	if err != nil || info.Version != version || info.Time != "2020-01-02T03:04:05Z" {
+		t.Errorf("info: %s err: %v want version: %s and the time of v1.2.3", b, err, version)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(vdir, version+".mod")); err != nil || string(b) != files["go.mod"] {
+		t.Errorf("mod: %s err: %v", b, err)
+	}
+
+	zipFile := filepath.Join(vdir, version+".zip")
+	checked, err := modzip.CheckZip(m, zipFile)
+	if err != nil {
+		t.Fatalf("CheckZip err: %v", err)
+	}
+	var got []string
+	for _, f := range checked.Valid {
+		got = append(got, strings.TrimPrefix(f, m.Path+"@"+m.Version+"/"))
+	}
+	want := "go.mod gweaver-manifest.json mod.go sub/sub.go testdata/data.txt"
+	if strings.Join(got, " ") != want {
+		t.Errorf("zip files: %s want: %s", strings.Join(got, " "), want)
+	}
+
+	// The checksums are those the go command computes for the module
+	zipHash, err := dirhash.HashZip(zipFile, dirhash.Hash1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum, err := ioutil.ReadFile(goSum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		fmt.Sprintf("example.com/Mod %s %s", version, zipHash),
+		fmt.Sprintf("example.com/Mod %s/go.mod h1:", version),
+	} {
+		if !strings.Contains(string(sum), line) {
+			t.Errorf("go.sum:\n%s\nhas no: %s", sum, line)
+		}
+	}
+	gomod, err := ioutil.ReadFile(goMod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(gomod), replace) || !strings.Contains(string(gomod), "replace example.com/Mod => example.com/Mod "+version) {
+		t.Errorf("go.mod:\n%s\ndoes not replace the module with: %s", gomod, version)
+	}
+
+	// Publishing the same fork again gives the same version and leaves go.sum alone
+	if err := fk.writeProxy(dir, goMod, goSum); err != nil {
+		t.Fatalf("writeProxy err: %v", err)
+	}
+	if again, _ := ioutil.ReadFile(goSum); string(again) != string(sum) {
+		t.Errorf("go.sum changed:\n%s\nwas:\n%s", again, sum)
+	}
+}
@@ -0,0 +1,226 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go/ast"
+	"go/types"
+	"gweaver/weave"
+	"strings"
+)
+
+// weaveRenames gives the declarations of the rename weaves their new names in file f, along with every reference
+// to them info resolves. The declarations changed are marked touched. It returns the weave of the last rename, nil if
+// there was none.
+func (p *source) weaveRenames(renames []*weave.Rename, info *types.Info, f *ast.File) (w *weave.Weave) {
+	if len(renames) == 0 {
+		return nil
+	}
+	fn := p.pkg.Fset.Position(f.Package).Filename
+	if info == nil || p.types == nil {
+		log.Warnf("weaveRenames: %s: no type information, nothing is renamed", fn)
+		return nil
+	}
+	targets := make(map[string]*weave.Rename)
+	for _, r := range renames {
+		if _, ok := p.clashes[r]; !ok {
+			p.clashes[r] = p.renameClashes(r)
+		}
+		if !p.clashes[r] {
+			targets[r.FullName()] = r
+		}
+	}
+
+	for _, d := range f.Decls {
+		ast.Inspect(d, func(n ast.Node) bool {
+			id, ok := n.(*ast.Ident)
+			if !ok {
+				return true
+			}
+			def := info.Defs[id]
+			obj := def
+			if obj == nil {
+				obj = info.Uses[id]
+			}
+			r, ok := targets[objectName(obj)]
+			if !ok {
+				// The type of an embedded field also names the field, the selectors of the field would need renaming too
+				if v, isVar := def.(*types.Var); isVar && v.Embedded() && targets[objectName(info.Uses[id])] != nil {
+					log.Warnf("weaveRenames: %s: %s is embedded, it is left alone", p.pkg.Fset.Position(id.Pos()), id.Name)
+				}
+				return true
+			}
+			if def != nil {
+				// The wrapper kept under the old name of a method still implements the interfaces
+				if r.Alias {
+					p.forward(r, obj, info, f)
+				} else {
+					p.checkRename(r, obj)
+				}
+				r.Renamed()
+			}
+			log.Debugf("weaveRenames: %s: %s renamed to: %s", p.pkg.Fset.Position(id.Pos()), id.Name, r.To)
+			r.Apply(id)
+			p.touched[d] = true
+			w = r.Weave()
+			return true
+		})
+	}
+	return
+}
+
+// objectName is the package path qualified name of a package level object or of a method, see types.Func.FullName,
+// empty for any other object
+func objectName(obj types.Object) string {
+	if fn, ok := obj.(*types.Func); ok {
+		return fn.Origin().FullName()
+	}
+	if obj == nil || obj.Pkg() == nil || obj.Parent() != obj.Pkg().Scope() {
+		return ""
+	}
+	return obj.Pkg().Path() + "." + obj.Name()
+}
+
+// renameClashes reports whether the new name of r is taken already, by a package level name or a field or method of
+// the receiver type
+func (p *source) renameClashes(r *weave.Rename) bool {
+	i := strings.Index(r.Name, ".")
+	if i < 0 {
+		if p.types.Scope().Lookup(r.To) != nil {
+			log.Warnf("weaveRenames: %s cannot be renamed, the package already declares: %s", r.Name, r.To)
+			return true
+		}
+		return false
+	}
+	tn, ok := p.types.Scope().Lookup(strings.Trim(r.Name[:i], "(*)")).(*types.TypeName)
+	if !ok {
+		return false
+	}
+	if obj, _, _ := types.LookupFieldOrMethod(types.NewPointer(tn.Type()), true, p.types, r.To); obj != nil {
+		log.Warnf("weaveRenames: %s cannot be renamed, %s already has: %s", r.Name, tn.Name(), r.To)
+		return true
+	}
+	return false
+}
+
+// checkRename reports the interfaces of the package a renamed method's type would stop implementing
+func (p *source) checkRename(r *weave.Rename, obj types.Object) {
+	fn, ok := obj.(*types.Func)
+	if !ok {
+		return
+	}
+	sig := fn.Type().(*types.Signature)
+	if sig.Recv() == nil {
+		return
+	}
+	scope := p.types.Scope()
+	for _, name := range scope.Names() {
+		tn, ok := scope.Lookup(name).(*types.TypeName)
+		if !ok {
+			continue
+		}
+		iface, ok := tn.Type().Underlying().(*types.Interface)
+		if !ok || iface.Empty() {
+			continue
+		}
+		for i := 0; i < iface.NumMethods(); i++ {
+			if iface.Method(i).Name() == fn.Name() && types.Implements(sig.Recv().Type(), iface) {
+				log.Warnf("weaveRenames: renaming %s would make %s no longer implement %s", r.Name, types.TypeString(sig.Recv().Type(), types.RelativeTo(p.types)), tn.Name())
+			}
+		}
+	}
+}
+
+// forward generates the declaration keeping the old name of obj working: a wrapper of a function or method, an alias
+// of a type, a constant of a constant
+func (p *source) forward(r *weave.Rename, obj types.Object, info *types.Info, f *ast.File) {
+	qualifier := func(pkg *types.Package) string {
+		if pkg == p.types {
+			return ""
+		}
+		if name := importName(info, f, pkg.Path()); name != "" {
+			return name
+		}
+		return pkg.Name()
+	}
+	old := obj.Name()
+	doc := fmt.Sprintf("// Deprecated: %s is the name of %s before the rename, use %s instead.\n", old, r.To, r.To)
+	var text string
+	switch o := obj.(type) {
+	case *types.Func:
+		sig := o.Type().(*types.Signature)
+		if sig.TypeParams().Len() > 0 || (sig.Recv() != nil && sig.RecvTypeParams().Len() > 0) {
+			log.Warnf("weaveRenames: %s is generic, no wrapper is kept under its old name", r.Name)
+			return
+		}
+		recv := ""
+		if v := sig.Recv(); v != nil {
+			name := v.Name()
+			if name == "" || name == "_" {
+				name = "r"
+			}
+			recv = name + " " + types.TypeString(v.Type(), qualifier)
+		}
+		text = doc + forwardFunc(old, r.To, recv, sig, qualifier)
+	case *types.TypeName:
+		if named, ok := o.Type().(*types.Named); ok && named.TypeParams().Len() > 0 {
+			log.Warnf("weaveRenames: %s is generic, no alias is kept under its old name", r.Name)
+			return
+		}
+		text = fmt.Sprintf("%stype %s = %s", doc, old, r.To)
+	case *types.Const:
+		text = fmt.Sprintf("%sconst %s = %s", doc, old, r.To)
+	default:
+		log.Warnf("weaveRenames: %s is a variable, the old name cannot forward to it", r.Name)
+		return
+	}
+	d := &ast.FuncDecl{Name: ast.NewIdent(old), Type: &ast.FuncType{}}
+	p.generated[d] = generatedDecl{op: "rename", text: []byte(text)}
+	p.appended = append(p.appended, d)
+}
+
+// forwardFunc is a function called name with the parameters and results of sig calling the one called to. With a
+// receiver, e.g. "c *Client", it is a method calling the method to of the receiver.
+func forwardFunc(name string, to string, recv string, sig *types.Signature, qualifier types.Qualifier) string {
+	var b bytes.Buffer
+	b.WriteString("func ")
+	call := to
+	if recv != "" {
+		fmt.Fprintf(&b, "(%s) ", recv)
+		call = strings.Fields(recv)[0] + "." + to
+	}
+	params := sig.Params()
+	var names []string
+	b.WriteString(name + "(")
+	for i := 0; i < params.Len(); i++ {
+		v := params.At(i)
+		pn := v.Name()
+		if pn == "" || pn == "_" {
+			pn = fmt.Sprintf("p%d", i)
+		}
+		t := types.TypeString(v.Type(), qualifier)
+		if sig.Variadic() && i == params.Len()-1 {
+			t = "..." + strings.TrimPrefix(t, "[]")
+			pn += "..."
+		}
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s %s", strings.TrimSuffix(pn, "..."), t)
+		names = append(names, pn)
+	}
+	b.WriteString(")")
+	switch res := sig.Results(); {
+	case res.Len() == 1 && res.At(0).Name() == "":
+		b.WriteString(" " + types.TypeString(res.At(0).Type(), qualifier))
+	case res.Len() > 0:
+		b.WriteString(" " + types.TypeString(res, qualifier))
+	}
+	body := call + "(" + strings.Join(names, ", ") + ")"
+	if sig.Results().Len() > 0 {
+		body = "return " + body
+	}
+	fmt.Fprintf(&b, " {\n\t%s\n}", body)
+	return b.String()
+}
@@ -0,0 +1,97 @@
+package pkg
+
+import "testing"
+
+// renameTarget declares what the weaves rename, renameOther refers to it from another file of the package
+const (
+	renameTarget = `package target
+
+type conn struct{ n int }
+
+func (c *conn) read() int { return c.n }
+
+const limit = 3
+
+type state int
+
+func dial() *conn { return &conn{n: limit} }
+
+func use() int {
+	var s state
+	_ = s
+	c := dial()
+	return c.read()
+}
+`
+	renameOther = `package target
+
+func again() int { return dial().read() + limit }
+`
+)
+
+func TestWeaveRenames(t *testing.T) {
+	tests := []struct {
+		name  string
+		weave string
+		// want is what each woven file holds
+		want map[string][]string
+	}{
+		{
+			name:  "function",
+			weave: "// +weaver rename Dial\nfunc dial()\n",
+			want: map[string][]string{
+				"target.go": {"func Dial() *conn {", "c := Dial()"},
+				"other.go":  {"Dial().read()"},
+			},
+		},
+		{
+			name:  "method",
+			weave: "// +weaver rename Read\nfunc (c *conn) read()\n",
+			want: map[string][]string{
+				"target.go": {"func (c *conn) Read() int {", "return c.Read()"},
+				"other.go":  {"dial().Read()"},
+			},
+		},
+		{
+			name:  "function with a wrapper",
+			weave: "// +weaver rename Dial alias\nfunc dial()\n",
+			want: map[string][]string{
+				"target.go": {"c := Dial()", "// Deprecated: dial is the name of Dial before the rename, use Dial instead.\n", "func dial() *conn {\n\treturn Dial()\n}"},
+				"other.go":  {"Dial().read()"},
+			},
+		},
+		{
+			name:  "method with a wrapper",
+			weave: "// +weaver rename Read alias\nfunc (c *conn) read()\n",
+			want: map[string][]string{
+				"target.go": {"func (c *conn) Read() int {", "func (c *conn) read() int {\n\treturn c.Read()\n}"},
+				"other.go":  {"dial().Read()"},
+			},
+		},
+		{
+			name:  "type with an alias",
+			weave: "// +weaver rename State alias\ntype state int\n",
+			want:  map[string][]string{"target.go": {"type State int", "var s State", "type state = State"}},
+		},
+		{
+			name:  "constant with an alias",
+			weave: "// +weaver rename Limit alias\nconst limit = 0\n",
+			want: map[string][]string{
+				"target.go": {"const Limit = 3", "&conn{n: Limit}", "const limit = Limit"},
+				"other.go":  {"+ Limit"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := map[string]string{"target.go": renameTarget, "other.go": renameOther}
+			m, wp := weaveTarget(t, files, map[string]string{"target.go": "package target\n\n" + tt.weave})
+			if s := statuses(wp); s != "rename "+wp.Report()[0].Name+": applied" {
+				t.Errorf("operations: %s", s)
+			}
+			for fn, want := range tt.want {
+				contains(t, m, fn, want...)
+			}
+		})
+	}
+}
@@ -0,0 +1,548 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"gweaver/weave"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// render produces the content of a woven file. Declarations the weave did not touch keep their original bytes,
+// only the declarations it inserted, replaced or modified are printed, so a fork differs from upstream only where
+// the weaves say it should. //line directives map the lines that moved back to the weave or upstream file they
+// came from so stack traces, coverage and debuggers point at real source. plain is the woven content without the
+// generated header and the //line directives, patches are made of it.
+func (p *source) render(f *ast.File, w *weave.Weave) (content []byte, plain []byte) {
+	fn := p.pkg.Fset.File(f.Package).Name()
+	src, err := ioutil.ReadFile(fn)
+	if err != nil {
+		log.Warnf("render: unable to read original source, reprinting the whole file err: %+v", err)
+		return p.reprint(f, w)
+	}
+	if w == nil {
+		return src, src
+	}
+	return p.rewrite(f, w, src)
+}
+
+// generatedHeader marks woven files as machine-modified for linters, code search and reviewers, see
+// https://golang.org/s/generatedcode
+const generatedHeader = "// Code generated by gweaver. DO NOT EDIT.\n\n"
+
+// provenance is the comment recording which weave a woven node came from. It uses the directive form so it is not
+// part of the node's doc.
+func provenance(w *weave.Weave, n ast.Node) string {
+	op := w.Op(n)
+	if op == "" {
+		op = "insert"
+	}
+	return provenanceOf(op, w)
+}
+
+// provenanceOf is the provenance comment of what operation op of weave w generated
+func provenanceOf(op string, w *weave.Weave) string {
+	return fmt.Sprintf("//gweaver:woven %s %s %s", op, filepath.ToSlash(w.Filename()), Version)
+}
+
+// withProvenance adds the provenance comment between a printed node's doc comment and the node itself
+func withProvenance(chunk []byte, comment string) []byte {
+	lines := strings.SplitAfter(string(chunk), "\n")
+	i := 0
+	for i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), "//") {
+		i++
+	}
+	sep := ""
+	if i > 0 {
+		sep = docSeparator(lines[i-1])
+	}
+	return []byte(strings.Join(lines[:i], "") + sep + comment + "\n" + strings.Join(lines[i:], ""))
+}
+
+// span is the byte range of an original declaration including its doc comment and a trailing line comment
+type span struct {
+	start, end int
+}
+
+func (p *source) rewrite(f *ast.File, w *weave.Weave, src []byte) (content []byte, plain []byte) {
+	fset := p.pkg.Fset
+	tf := fset.File(f.Package)
+	if len(p.original) == 0 {
+		return p.reprint(f, w)
+	}
+
+	index := make(map[ast.Decl]int)
+	spans := make([]span, len(p.original))
+	for i, d := range p.original {
+		index[d] = i
+		spans[i] = span{tf.Offset(nodeStart(d)), lineEnd(src, tf.Offset(p.ends[i]))}
+	}
+	// gap returns the bytes between original declaration i and the one before it
+	gap := func(i int) []byte {
+		if i == 0 {
+			return nil
+		}
+		return src[spans[i-1].end:spans[i].start]
+	}
+
+	comments := p.keptComments(f)
+	var out bytes.Buffer
+	out.Write(src[:spans[0].start])
+	last := -1
+	// dropRemoved writes what is left of the original declarations removed between last and i
+	dropRemoved := func(i int) {
+		for j := last + 1; j < i; j++ {
+			if g := gap(j); len(bytes.TrimSpace(g)) > 0 {
+				out.Write(g)
+			}
+		}
+	}
+	for _, d := range f.Decls {
+		i, original := index[d]
+		if g, ok := p.generated[d]; ok {
+			writeChunk(&out, withProvenance(formatChunk(g.text), provenanceOf(g.op, w)))
+			continue
+		}
+		if !original {
+			writeChunk(&out, withProvenance(formatChunk(w.Print(d)), provenance(w, d)))
+			continue
+		}
+		dropRemoved(i)
+		out.Write(gap(i))
+		last = i
+		gd, isGenDecl := d.(*ast.GenDecl)
+		mixed := isGenDecl && hasWovenSpec(gd, w)
+		if edits, ok := p.edits[d]; ok {
+			if p.touched[d] || mixed {
+				log.Warnf("rewrite: %s: declaration at line: %d has both field and other changes, only the field changes are kept", tf.Name(), tf.Line(d.Pos()))
+			}
+			out.Write(formatChunk(applyEdits(src, spans[i].start, spans[i].end, edits)))
+			continue
+		}
+		if !p.touched[d] && !mixed {
+			out.Write(src[spans[i].start:spans[i].end])
+			continue
+		}
+		var chunk []byte
+		if mixed {
+			chunk = p.printMixedGenDecl(gd, w, comments)
+		} else {
+			chunk = printNode(fset, &printer.CommentedNode{Node: d, Comments: comments})
+		}
+		if isGenDecl && gd.Tok == token.IMPORT {
+			chunk = formatImports(chunk)
+		} else {
+			chunk = formatChunk(chunk)
+		}
+		// Keep a trailing line comment the printer did not pick up
+		trailing := bytes.TrimSpace(src[tf.Offset(p.ends[i]):spans[i].end])
+		if len(trailing) > 0 && !bytes.HasSuffix(chunk, trailing) {
+			chunk = append(append(chunk, ' '), trailing...)
+		}
+		out.Write(chunk)
+	}
+	dropRemoved(len(p.original))
+	out.Write(src[spans[len(spans)-1].end:])
+	// A woven declaration at the end of a file lacking the final newline gets the one gofmt adds
+	if !bytes.HasSuffix(out.Bytes(), []byte("\n")) {
+		out.WriteByte('\n')
+	}
+
+	plain = out.Bytes()
+	content = lineDirectives(append([]byte(generatedHeader), plain...), sourceName(tf.Name()), p.mgr.wovenName(tf.Name()), f.Decls, func(d ast.Decl) token.Position {
+		if pos, ok := w.Position(d); ok {
+			return pos
+		}
+		return fset.Position(d.Pos())
+	})
+	return
+}
+
+// writeChunk appends a printed declaration separated from what precedes it by a single blank line
+func writeChunk(out *bytes.Buffer, chunk []byte) {
+	trimmed := bytes.TrimRight(out.Bytes(), " \t\n")
+	out.Truncate(len(trimmed))
+	out.WriteString("\n\n")
+	out.Write(chunk)
+}
+
+// lineEnd extends end over the rest of its line when that only holds blanks or a line comment
+func lineEnd(src []byte, end int) int {
+	i := bytes.IndexByte(src[end:], '\n')
+	if i < 0 {
+		i = len(src) - end
+	}
+	rest := strings.TrimSpace(string(src[end : end+i]))
+	if rest == "" || strings.HasPrefix(rest, "//") {
+		return end + len(strings.TrimRight(string(src[end:end+i]), " \t\r"))
+	}
+	return end
+}
+
+// formatChunk gofmt's a list of printed declarations, it is returned as-is if it does not parse
+func formatChunk(chunk []byte) []byte {
+	formatted, err := format.Source(chunk)
+	if err != nil {
+		log.Warnf("formatChunk: unable to format woven declaration err: %+v", err)
+		return chunk
+	}
+	return bytes.TrimRight(formatted, "\n")
+}
+
+// formatImports gofmt's a printed import declaration, sorting its specs the way gofmt only does in whole files
+func formatImports(chunk []byte) []byte {
+	const clause = "package p\n\n"
+	formatted, err := format.Source(append([]byte(clause), chunk...))
+	if err != nil {
+		return formatChunk(chunk)
+	}
+	return bytes.TrimRight(bytes.TrimPrefix(formatted, []byte(clause)), "\n")
+}
+
+// reprint prints the whole woven file, it is the fallback when the original source cannot be read. Weave nodes
+// carry positions from the weave's own FileSet which mean nothing in the target's, so each top-level declaration
+// is printed on its own with the FileSet and comments it came from and the result is gofmt'ed.
+func (p *source) reprint(f *ast.File, w *weave.Weave) (content []byte, plain []byte) {
+	fset := p.pkg.Fset
+	if len(p.edits) > 0 {
+		log.Warnf("reprint: %s: field changes need the original source, they are lost", fset.Position(f.Package).Filename)
+	}
+	comments := p.keptComments(f)
+
+	var chunks [][]byte
+	header := &ast.File{Package: f.Package, Name: f.Name}
+	for _, cg := range comments {
+		if cg.Pos() < f.Name.End() {
+			header.Comments = append(header.Comments, cg)
+		}
+	}
+	chunks = append(chunks, printNode(fset, header))
+
+	// prev is the end of the last original declaration, comments between it and the next one float before that one
+	prev := f.Name.End()
+	for _, d := range f.Decls {
+		if g, ok := p.generated[d]; ok {
+			chunks = append(chunks, withProvenance(g.text, provenanceOf(g.op, w)))
+			continue
+		}
+		if w != nil && w.Owns(d) {
+			chunks = append(chunks, withProvenance(w.Print(d), provenance(w, d)))
+			continue
+		}
+		var chunk bytes.Buffer
+		chunk.Write(floatingComments(fset, comments, prev, d))
+		if gd, ok := d.(*ast.GenDecl); ok && w != nil && hasWovenSpec(gd, w) {
+			chunk.Write(p.printMixedGenDecl(gd, w, comments))
+		} else {
+			chunk.Write(printNode(fset, &printer.CommentedNode{Node: d, Comments: comments}))
+		}
+		chunks = append(chunks, chunk.Bytes())
+		prev = d.End()
+	}
+	if trailing := floatingComments(fset, comments, prev, nil); len(trailing) > 0 {
+		chunks = append(chunks, trailing)
+	}
+
+	src := bytes.Join(chunks, []byte("\n\n"))
+	if w != nil {
+		src = append([]byte(generatedHeader), src...)
+	}
+	formatted, err := format.Source(src)
+	if err != nil {
+		log.Errorf("reprint: %s: woven source is not valid Go, writing it unformatted err: %+v", fset.Position(f.Package).Filename, err)
+		return src, bytes.TrimPrefix(src, []byte(generatedHeader))
+	}
+
+	plain = bytes.TrimPrefix(formatted, []byte(generatedHeader))
+	content = lineDirectives(formatted, "", p.mgr.wovenName(fset.Position(f.Package).Filename), f.Decls, func(d ast.Decl) token.Position {
+		if w != nil {
+			if pos, ok := w.Position(d); ok {
+				return pos
+			}
+		}
+		return fset.Position(d.Pos())
+	})
+	return
+}
+
+// keptComments drops the comments belonging to the nodes the weave replaced or deleted
+func (p *source) keptComments(f *ast.File) (kept []*ast.CommentGroup) {
+	for _, cg := range f.Comments {
+		removed := false
+		for _, n := range p.removed {
+			if cg.Pos() >= nodeStart(n) && cg.End() <= n.End() {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			kept = append(kept, cg)
+		}
+	}
+	return
+}
+
+// floatingComments prints the comment groups between from and the start of d, excluding d's doc comment.
+// A nil d takes every comment after from.
+func floatingComments(fset *token.FileSet, comments []*ast.CommentGroup, from token.Pos, d ast.Decl) []byte {
+	var b bytes.Buffer
+	to := token.Pos(-1)
+	if d != nil {
+		to = nodeStart(d)
+	}
+	lastLine := 0
+	for _, cg := range comments {
+		if cg.Pos() <= from || (to >= 0 && cg.End() > to) {
+			continue
+		}
+		line := fset.Position(cg.Pos()).Line
+		if lastLine > 0 && line > lastLine+1 {
+			b.WriteString("\n")
+		}
+		for _, c := range cg.List {
+			b.WriteString(c.Text + "\n")
+		}
+		lastLine = fset.Position(cg.End()).Line
+	}
+	if b.Len() > 0 && d != nil {
+		b.WriteString("\n")
+	}
+	return b.Bytes()
+}
+
+func hasWovenSpec(gd *ast.GenDecl, w *weave.Weave) bool {
+	for _, s := range gd.Specs {
+		if w.Owns(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// printMixedGenDecl prints an original const, type or var declaration one of whose specs was replaced by a weave
+func (p *source) printMixedGenDecl(gd *ast.GenDecl, w *weave.Weave, comments []*ast.CommentGroup) []byte {
+	var b bytes.Buffer
+	if gd.Doc != nil {
+		for _, c := range gd.Doc.List {
+			b.WriteString(c.Text + "\n")
+		}
+	}
+	if !gd.Lparen.IsValid() && len(gd.Specs) == 1 && w.Owns(gd.Specs[0]) {
+		// The keyword goes after the doc of the woven spec
+		lines := strings.SplitAfter(string(w.Print(gd.Specs[0])), "\n")
+		i := 0
+		for i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), "//") {
+			i++
+		}
+		chunk := strings.Join(lines[:i], "") + gd.Tok.String() + " " + strings.Join(lines[i:], "")
+		b.Write(withProvenance([]byte(chunk), provenance(w, gd.Specs[0])))
+		return bytes.TrimRight(b.Bytes(), "\n")
+	}
+	b.WriteString(gd.Tok.String() + " ")
+	if gd.Lparen.IsValid() {
+		b.WriteString("(\n")
+	}
+	for _, s := range gd.Specs {
+		if w.Owns(s) {
+			b.Write(withProvenance(w.Print(s), provenance(w, s)))
+		} else {
+			b.Write(printNode(p.pkg.Fset, &printer.CommentedNode{Node: s, Comments: comments}))
+		}
+		b.WriteString("\n")
+	}
+	if gd.Lparen.IsValid() {
+		b.WriteString(")")
+	}
+	return b.Bytes()
+}
+
+func printNode(fset *token.FileSet, n interface{}) []byte {
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, n); err != nil {
+		log.Errorf("printNode: error printing node: %+v", err)
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n")
+}
+
+// nodeStart is where a declaration or spec starts including its doc comment
+func nodeStart(n ast.Node) token.Pos {
+	var doc *ast.CommentGroup
+	switch t := n.(type) {
+	case *ast.FuncDecl:
+		doc = t.Doc
+	case *ast.GenDecl:
+		doc = t.Doc
+	case *ast.TypeSpec:
+		doc = t.Doc
+	case *ast.ValueSpec:
+		doc = t.Doc
+	}
+	if doc != nil {
+		return doc.Pos()
+	}
+	return n.Pos()
+}
+
+// lineDirectives inserts //line directives into src so each top-level declaration maps back to where it came from.
+// decls are the declarations src was produced from and origin tells where each of them starts, generated
+// declarations have no origin and map to the woven file itself, named self. Lines of src initially map to the same
+// lines of identity, a directive is only inserted where that mapping no longer holds. An empty identity maps nothing
+// so every declaration gets a directive. A directive goes before a declaration's doc comment with a blank line on
+// either side, never inside it, so gofmt leaves the woven file as it is, and names files with sourceName.
+func lineDirectives(src []byte, identity string, self string, decls []ast.Decl, origin func(d ast.Decl) token.Position) []byte {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		log.Warnf("lineDirectives: unable to parse woven source, skipping //line directives err: %+v", err)
+		return src
+	}
+	if len(f.Decls) != len(decls) {
+		log.Warnf("lineDirectives: woven source has %d declarations expected %d, skipping //line directives", len(f.Decls), len(decls))
+		return src
+	}
+	lines := strings.SplitAfter(string(src), "\n")
+	blank := func(line int) bool { return line >= 1 && line <= len(lines) && strings.TrimSpace(lines[line-1]) == "" }
+
+	// The line at of src currently maps to line base of file
+	file, at, base := identity, 1, 1
+	// directives maps a line of src to the lines inserted before it, inserted counts them
+	directives := make(map[int]string)
+	inserted := 0
+	for i, d := range f.Decls {
+		line := fset.Position(d.Pos()).Line
+		start := fset.Position(nodeStart(d)).Line
+		// The declaration's line maps to line want of file name, a generated declaration has no origin, its lines
+		// are those of the woven file once the directives before it are in
+		name, want, generated := self, line+inserted, true
+		if pos := origin(decls[i]); pos.IsValid() {
+			name, want, generated = sourceName(pos.Filename), pos.Line, false
+		}
+		if file != "" && file == name && base+line-at == want {
+			continue
+		}
+		// The directive maps the blank line after it, the doc comment starts on the next line
+		before := ""
+		if !blank(start - 1) {
+			before = "\n"
+		}
+		directive, after := before+"//line %s:%d\n\n", 1
+		dl, mapped := start, want-(line-start)-after
+		// A doc comment longer than the lines before the original declaration leaves no room, but for the cgo
+		// preamble the directive then ends the doc comment
+		if gd, ok := d.(*ast.GenDecl); mapped < 1 && !(ok && isCgoImport(gd)) {
+			directive, after = docSeparator(lines[line-2])+"//line %s:%d\n", 0
+			dl, mapped = line, want
+		}
+		n := strings.Count(directive, "\n")
+		// The lines of a generated declaration move down by those of its own directive
+		if generated {
+			mapped += n
+		}
+		if mapped < 1 {
+			mapped = 1
+		}
+		directives[dl] = fmt.Sprintf(directive, name, mapped)
+		// The lines after the directive map from mapped on, src line dl comes next
+		file, at, base = name, dl, mapped+after
+		inserted += n
+	}
+
+	var out bytes.Buffer
+	for i, line := range lines {
+		out.WriteString(directives[i+1])
+		out.WriteString(line)
+	}
+	return out.Bytes()
+}
+
+// TrimPath names the files of //line directives relative like -trimpath names them, so forks built on different
+// machines are identical: module cache files are named module@version/path, main module files module/path and
+// standard library files are named relative to GOROOT/src. By default files are named by their absolute path, which
+// debuggers, coverage tools and editors open as they are.
+var TrimPath bool
+
+// sourceName is the name //line directives give file fn, see TrimPath. Files outside of the roots TrimPath names
+// files relative to keep their absolute path.
+func sourceName(fn string) string {
+	if fn == "" {
+		return ""
+	}
+	if abs, err := filepath.Abs(fn); err == nil {
+		fn = abs
+	}
+	if !TrimPath {
+		return fn
+	}
+	sourceRoots.once.Do(func() {
+		mod, dir := MainModule()
+		for _, r := range [][2]string{{dir, mod}, {goEnv("GOMODCACHE"), ""}, {filepath.Join(goEnv("GOROOT"), "src"), ""}} {
+			if r[0] != "" {
+				sourceRoots.roots = append(sourceRoots.roots, r)
+			}
+		}
+	})
+	for _, r := range sourceRoots.roots {
+		rel, err := filepath.Rel(r[0], fn)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		return path.Join(r[1], filepath.ToSlash(rel))
+	}
+	return fn
+}
+
+// sourceRoots are the directories sourceName names files relative to, with the prefix of their names
+var sourceRoots struct {
+	once  sync.Once
+	roots [][2]string
+}
+
+// isCgoImport reports whether gd is import "C"
+func isCgoImport(gd *ast.GenDecl) bool {
+	if gd.Tok != token.IMPORT || len(gd.Specs) != 1 {
+		return false
+	}
+	is, ok := gd.Specs[0].(*ast.ImportSpec)
+	return ok && is.Path.Value == `"C"`
+}
+
+// docSeparator is the empty comment line gofmt puts between the text of a doc comment ending with line and the
+// directives following it
+func docSeparator(line string) string {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "//") || isDirective(line) {
+		return ""
+	}
+	return "//\n"
+}
+
+// isDirective reports whether a comment line is a directive such as //go:noinline or //line, see go/ast
+func isDirective(c string) bool {
+	if strings.HasPrefix(c, "//line ") || strings.HasPrefix(c, "//extern ") || strings.HasPrefix(c, "//export ") {
+		return true
+	}
+	c = strings.TrimPrefix(c, "//")
+	colon := strings.Index(c, ":")
+	if colon <= 0 || colon+1 >= len(c) {
+		return false
+	}
+	for i := 0; i <= colon+1; i++ {
+		if i == colon {
+			continue
+		}
+		b := c[i]
+		if !('a' <= b && b <= 'z' || '0' <= b && b <= '9') {
+			return false
+		}
+	}
+	return true
+}
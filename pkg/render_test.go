@@ -0,0 +1,247 @@
+package pkg
+
+import (
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// renderTarget is gofmt-clean, its declarations are split at the blank lines between them
+const renderTarget = `// Package target is a fixture.
+package target
+
+import "fmt"
+
+// Keep is left alone.
+func Keep() string { return "keep" }
+
+// Greet greets.
+func Greet(name string) string {
+	return fmt.Sprint("hello ", name)
+}
+
+var (
+	a = 1 // a
+	b = 2
+)
+
+// T is a type.
+type T struct {
+	X int // the x
+}
+
+func last() int { return 1 } // trailing
+`
+
+func TestRewrite(t *testing.T) {
+	decls := strings.Split(renderTarget, "\n\n")[2:]
+	tests := []struct {
+		name  string
+		weave string
+		// touched are the indexes of the declarations of renderTarget the weave changes, want what it adds
+		touched []int
+		want    []string
+		// line is the declaration whose //line directive is checked and the line it maps to in the weave
+		decl string
+		line int
+	}{
+		{
+			name:    "replace a function",
+			weave:   "package target\n\nimport \"fmt\"\n\n// +weaver replace\nfunc Greet(name string) string {\n\treturn fmt.Sprint(\"hi \", name)\n}\n",
+			touched: []int{1},
+			want:    []string{"func Greet(name string) string {\n\treturn fmt.Sprint(\"hi \", name)\n}\n"},
+			decl:    "Greet", line: 6,
+		},
+		{
+			name:    "replace the first declaration",
+			weave:   "package target\n\n// Keep is woven.\n// +weaver replace\nfunc Keep() string { return \"woven\" }\n",
+			touched: []int{0},
+			want:    []string{"// Keep is woven.\n//\n//gweaver:woven replace", "func Keep() string { return \"woven\" }\n\n//line "},
+			decl:    "Keep", line: 5,
+		},
+		{
+			name:    "replace the last declaration",
+			weave:   "package target\n\n// +weaver replace\nfunc last() int { return 2 }\n",
+			touched: []int{4},
+			want:    []string{"func last() int { return 2 }\n"},
+			decl:    "last", line: 4,
+		},
+		{
+			name:    "delete the last declaration",
+			weave:   "package target\n\n// +weaver delete\nfunc last() int { return 2 }\n",
+			touched: []int{4},
+			want:    []string{"type T struct {\n\tX int // the x\n}\n"},
+		},
+		{
+			name:  "insert before the first function",
+			weave: "package target\n\n// Added is new.\n// +weaver insert\nfunc Added() {}\n",
+			want:  []string{"import \"fmt\"\n\n//line ", "// Added is new.\n//\n//gweaver:woven insert", "func Added() {}\n\n//line "},
+			decl:  "Added", line: 5,
+		},
+		{
+			name:    "replace a spec",
+			weave:   "package target\n\n// +weaver replace\nvar b = 3\n",
+			touched: []int{2},
+			want:    []string{"\ta = 1 // a\n", "\tb = 3\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, wp := weaveTarget(t, map[string]string{"target.go": renderTarget}, map[string]string{"target.go": tt.weave})
+			if s := statuses(wp); strings.Contains(s, "unmatched") {
+				t.Fatalf("operations: %s", s)
+			}
+			for _, content := range []string{m.files["target.go"], m.plain["target.go"]} {
+				formatted, err := format.Source([]byte(content))
+				if err != nil || string(formatted) != content {
+					t.Errorf("woven file is not gofmt-clean err: %v\n%s\ngofmt:\n%s", err, content, formatted)
+				}
+			}
+			touched := make(map[int]bool)
+			for _, i := range tt.touched {
+				touched[i] = true
+			}
+			for i, d := range decls {
+				if !touched[i] && !strings.Contains(m.plain["target.go"], strings.TrimSuffix(d, "\n")) {
+					t.Errorf("untouched declaration:\n%s\nchanged:\n%s", d, m.plain["target.go"])
+				}
+			}
+			contains(t, m, "target.go", tt.want...)
+			if !strings.HasPrefix(m.files["target.go"], generatedHeader) || strings.HasPrefix(m.plain["target.go"], generatedHeader) {
+				t.Errorf("generated header missing from the woven file or in the plain one")
+			}
+			if strings.Contains(m.plain["target.go"], "//line") {
+				t.Errorf("plain file has //line directives:\n%s", m.plain["target.go"])
+			}
+			if tt.decl != "" {
+				fn, line := declPosition(t, m.files["target.go"], tt.decl)
+				if want := filepath.Join("ext", testModule, "target.go"); !strings.HasSuffix(fn, want) || line != tt.line {
+					t.Errorf("%s maps to %s:%d want: %s:%d", tt.decl, fn, line, want, tt.line)
+				}
+			}
+			// The untouched declarations after the woven ones map to the original file
+			fn, line := declPosition(t, m.files["target.go"], "T")
+			if !filepath.IsAbs(fn) || filepath.Base(fn) != "target.go" || strings.Contains(fn, "ext") || line != 20 {
+				t.Errorf("T maps to %s:%d want: target.go:20", fn, line)
+			}
+		})
+	}
+}
+
+// declPosition is where the //line directives of src say the declaration called name is
+func declPosition(t *testing.T, src string, name string) (string, int) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "woven.go", src, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range f.Decls {
+		switch d := d.(type) {
+		case *ast.FuncDecl:
+			if d.Name.Name == name {
+				pos := fset.Position(d.Pos())
+				return pos.Filename, pos.Line
+			}
+		case *ast.GenDecl:
+			for _, s := range d.Specs {
+				if ts, ok := s.(*ast.TypeSpec); ok && ts.Name.Name == name {
+					pos := fset.Position(ts.Pos())
+					return pos.Filename, pos.Line
+				}
+			}
+		}
+	}
+	t.Fatalf("%s not found in:\n%s", name, src)
+	return "", 0
+}
+
+func TestLineDirectives(t *testing.T) {
+	// The woven file of a weave inserting the second function, a generated declaration follows
+	src := "package p\n\nfunc a() {}\n// Doc of b.\nfunc b() {}\nfunc c() {}\n"
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "p.go", src, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origin := map[string]token.Position{"a": {Filename: "/up/p.go", Line: 3}, "b": {Filename: "/ext/p.go", Line: 10}}
+	out := lineDirectives([]byte(src), "/up/p.go", "/fork/p.go", f.Decls, func(d ast.Decl) token.Position {
+		return origin[d.(*ast.FuncDecl).Name.Name]
+	})
+	want := "package p\n\nfunc a() {}\n\n//line /ext/p.go:8\n\n// Doc of b.\nfunc b() {}\n\n//line /fork/p.go:11\n\nfunc c() {}\n"
+	if string(out) != want {
+		t.Errorf("lineDirectives:\n%s\nwant:\n%s", out, want)
+	}
+	for name, want := range map[string]string{"a": "woven.go:3", "b": "/ext/p.go:10", "c": "/fork/p.go:12"} {
+		if fn, line := declPosition(t, string(out), name); fn+":"+strconv.Itoa(line) != want {
+			t.Errorf("%s maps to %s:%d want: %s", name, fn, line, want)
+		}
+	}
+	if formatted, err := format.Source(out); err != nil || string(formatted) != string(out) {
+		t.Errorf("lineDirectives output is not gofmt-clean err: %v gofmt:\n%s", err, formatted)
+	}
+}
+
+func TestRewriteFileEnds(t *testing.T) {
+	const (
+		noNewline = "package target\n\nfunc a() int { return 1 }\n\nfunc b() int { return 2 }"
+		comments  = "package target\n\nfunc a() int { return 1 }\n\nfunc b() int { return 2 } // two\n\n// The end.\n"
+		replaceB  = "// +weaver replace\nfunc b() int { return 3 }\n"
+	)
+	tests := []struct {
+		name   string
+		target string
+		weave  string
+		// want is the plain woven file without its provenance comments
+		want string
+	}{
+		{
+			name:   "replace the last declaration of a file without a final newline",
+			target: noNewline,
+			weave:  replaceB,
+			want:   "package target\n\nfunc a() int { return 1 }\n\nfunc b() int { return 3 }\n",
+		},
+		{
+			name:   "delete the last declaration of a file without a final newline",
+			target: noNewline,
+			weave:  "// +weaver delete\nfunc b() {}\n",
+			want:   "package target\n\nfunc a() int { return 1 }\n",
+		},
+		{
+			name:   "replace the last declaration before a comment",
+			target: comments,
+			weave:  replaceB,
+			want:   "package target\n\nfunc a() int { return 1 }\n\nfunc b() int { return 3 }\n\n// The end.\n",
+		},
+		{
+			name:   "delete the last declaration before a comment",
+			target: comments,
+			weave:  "// +weaver delete\nfunc b() {}\n",
+			want:   "package target\n\nfunc a() int { return 1 }\n\n// The end.\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, wp := weaveTarget(t, map[string]string{"target.go": tt.target}, map[string]string{"target.go": "package target\n\n" + tt.weave})
+			if s := statuses(wp); !strings.HasSuffix(s, ": applied") {
+				t.Fatalf("operations: %s", s)
+			}
+			var lines []string
+			for _, l := range strings.SplitAfter(m.plain["target.go"], "\n") {
+				if !strings.HasPrefix(l, "//gweaver:woven ") && l != "//\n" {
+					lines = append(lines, l)
+				}
+			}
+			if got := strings.Join(lines, ""); got != tt.want {
+				t.Errorf("woven file:\n%q\nwant:\n%q", got, tt.want)
+			}
+			if formatted, err := format.Source([]byte(m.files["target.go"])); err != nil || string(formatted) != m.files["target.go"] {
+				t.Errorf("woven file is not gofmt-clean err: %v\n%s", err, m.files["target.go"])
+			}
+		})
+	}
+}
@@ -0,0 +1,381 @@
+package pkg
+
+import (
+	log "github.com/sirupsen/logrus"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"golang.org/x/tools/go/ast/astutil"
+	"gweaver/weave"
+	"reflect"
+)
+
+// weaveRules applies the rules of weave w to the functions of file f they are scoped to, the functions rewritten are
+// marked touched
+func (p *source) weaveRules(w *weave.Weave, f *ast.File) {
+	rules := w.Rules()
+	if len(rules) == 0 {
+		return
+	}
+	if p.info == nil {
+		log.Warnf("weaveRules: %s: no type information, its rules are not applied", p.pkg.Fset.Position(f.Package).Filename)
+		return
+	}
+	// Imports only the rewritten code used are dropped, not those the weave adds for its own declarations
+	var used []string
+	for _, is := range f.Imports {
+		if path := pathFix(is.Path.Value); astutil.UsesImport(f, path) {
+			used = append(used, path)
+		}
+	}
+	rewritten := false
+	defer func() {
+		if !rewritten {
+			return
+		}
+		for _, path := range used {
+			if dropUnusedImport(p.pkg.Fset, f, path) {
+				p.touchImports()
+			}
+		}
+	}()
+	for _, d := range f.Decls {
+		fd, ok := d.(*ast.FuncDecl)
+		if !ok || fd.Body == nil {
+			continue
+		}
+		name := w.TargetName(fd)
+		for _, r := range rules {
+			if !r.Applies(name) {
+				continue
+			}
+			var n int
+			if r.Expression() {
+				n = p.rewriteExprs(r, fd.Body)
+			} else {
+				n = p.rewriteStmts(r, fd.Body)
+			}
+			if n > 0 {
+				log.Debugf("weaveRules: %s: rule: %s rewrote: %d places", name, r.Name, n)
+				p.touched[fd] = true
+				rewritten = true
+			}
+		}
+	}
+}
+
+// rewriteExprs replaces the expressions of body matching an expression rule
+func (p *source) rewriteExprs(r *weave.Rule, body *ast.BlockStmt) (n int) {
+	before := r.Before[0].(*ast.ExprStmt).X
+	after := r.After[0].(*ast.ExprStmt).X
+	astutil.Apply(body, func(c *astutil.Cursor) bool {
+		e, ok := c.Node().(ast.Expr)
+		// The name of a selector can only be an identifier
+		if !ok || c.Name() == "Sel" {
+			return true
+		}
+		m := p.newMatcher(r)
+		if !m.match(reflect.ValueOf(before), reflect.ValueOf(e)) {
+			return true
+		}
+		c.Replace(m.subst(after, e.Pos()))
+		r.Rewritten()
+		n++
+		return false
+	}, nil)
+	return
+}
+
+// rewriteStmts replaces the sequences of statements of body matching a statement rule
+func (p *source) rewriteStmts(r *weave.Rule, body *ast.BlockStmt) (n int) {
+	ast.Inspect(body, func(node ast.Node) bool {
+		switch t := node.(type) {
+		case *ast.BlockStmt:
+			n += p.rewriteList(r, &t.List)
+		case *ast.CaseClause:
+			n += p.rewriteList(r, &t.Body)
+		case *ast.CommClause:
+			n += p.rewriteList(r, &t.Body)
+		}
+		return true
+	})
+	return
+}
+
+func (p *source) rewriteList(r *weave.Rule, list *[]ast.Stmt) (n int) {
+	var out []ast.Stmt
+	stmts := *list
+	for i := 0; i < len(stmts); {
+		if i+len(r.Before) <= len(stmts) {
+			m := p.newMatcher(r)
+			ok := true
+			for j, s := range r.Before {
+				if ok = m.match(reflect.ValueOf(s), reflect.ValueOf(stmts[i+j])); !ok {
+					break
+				}
+			}
+			if ok {
+				for _, s := range r.After {
+					out = append(out, m.subst(s, stmts[i].Pos()).(ast.Stmt))
+				}
+				i += len(r.Before)
+				r.Rewritten()
+				n++
+				continue
+			}
+		}
+		out = append(out, stmts[i])
+		i++
+	}
+	if n > 0 {
+		*list = out
+	}
+	return
+}
+
+// matcher matches the pattern of a rule against the code of the target, binding its wildcards
+type matcher struct {
+	p    *source
+	rule *weave.Rule
+	// bound holds the expressions the wildcards matched, rest the arguments variadic wildcards matched
+	bound map[string]ast.Expr
+	rest  map[string][]ast.Expr
+	// spread records the variadic wildcards whose call passed a slice with ...
+	spread map[string]bool
+}
+
+var (
+	identType    = reflect.TypeOf((*ast.Ident)(nil))
+	callExprType = reflect.TypeOf((*ast.CallExpr)(nil))
+	objectType   = reflect.TypeOf((*ast.Object)(nil))
+	scopeType    = reflect.TypeOf((*ast.Scope)(nil))
+	commentsType = reflect.TypeOf((*ast.CommentGroup)(nil))
+	positionType = reflect.TypeOf(token.NoPos)
+)
+
+func (p *source) newMatcher(r *weave.Rule) *matcher {
+	return &matcher{p: p, rule: r, bound: make(map[string]ast.Expr), rest: make(map[string][]ast.Expr), spread: make(map[string]bool)}
+}
+
+// wildcard returns the wildcard an identifier of the pattern stands for
+func (m *matcher) wildcard(v reflect.Value) (string, weave.Wildcard, bool) {
+	if m.rule == nil || v.Type() != identType || v.IsNil() {
+		return "", weave.Wildcard{}, false
+	}
+	id := v.Interface().(*ast.Ident)
+	wc, ok := m.rule.Wildcards[id.Name]
+	return id.Name, wc, ok
+}
+
+// match reports whether code v matches pattern p, positions, comments and resolved objects are ignored
+func (m *matcher) match(p, v reflect.Value) bool {
+	if p.Kind() == reflect.Interface {
+		p = p.Elem()
+	}
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	if !p.IsValid() || !v.IsValid() {
+		return p.IsValid() == v.IsValid()
+	}
+	if name, wc, ok := m.wildcard(p); ok && !wc.Variadic {
+		e, ok := v.Interface().(ast.Expr)
+		return ok && m.bind(name, wc, e)
+	}
+	if p.Type() != v.Type() {
+		return false
+	}
+	switch p.Type() {
+	case objectType, scopeType, commentsType, positionType:
+		return true
+	case identType:
+		if p.IsNil() || v.IsNil() {
+			return p.IsNil() == v.IsNil()
+		}
+		return p.Interface().(*ast.Ident).Name == v.Interface().(*ast.Ident).Name
+	case callExprType:
+		if !p.IsNil() && !v.IsNil() {
+			if ok, handled := m.matchVariadic(p.Interface().(*ast.CallExpr), v.Interface().(*ast.CallExpr)); handled {
+				return ok
+			}
+		}
+	}
+	switch p.Kind() {
+	case reflect.Ptr:
+		if p.IsNil() || v.IsNil() {
+			return p.IsNil() == v.IsNil()
+		}
+		return m.match(p.Elem(), v.Elem())
+	case reflect.Slice:
+		if p.Len() != v.Len() {
+			return false
+		}
+		for i := 0; i < p.Len(); i++ {
+			if !m.match(p.Index(i), v.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Struct:
+		for i := 0; i < p.NumField(); i++ {
+			if !m.match(p.Field(i), v.Field(i)) {
+				return false
+			}
+		}
+		return true
+	}
+	return p.Interface() == v.Interface()
+}
+
+// matchVariadic matches a call whose last argument in the pattern is a variadic wildcard, which takes the remaining
+// arguments of the call. handled is false for any other call.
+func (m *matcher) matchVariadic(p, v *ast.CallExpr) (ok bool, handled bool) {
+	if len(p.Args) == 0 {
+		return false, false
+	}
+	name, wc, isWildcard := m.wildcard(reflect.ValueOf(p.Args[len(p.Args)-1]))
+	if !isWildcard || !wc.Variadic {
+		return false, false
+	}
+	fixed := len(p.Args) - 1
+	if len(v.Args) < fixed || !m.match(reflect.ValueOf(p.Fun), reflect.ValueOf(v.Fun)) {
+		return false, true
+	}
+	for i := 0; i < fixed; i++ {
+		if !m.match(reflect.ValueOf(p.Args[i]), reflect.ValueOf(v.Args[i])) {
+			return false, true
+		}
+	}
+	for _, a := range v.Args[fixed:] {
+		// A slice passed with ... is not checked against the element type
+		if !v.Ellipsis.IsValid() && !m.typeOk(wc, a) {
+			return false, true
+		}
+	}
+	m.rest[name] = v.Args[fixed:]
+	m.spread[name] = v.Ellipsis.IsValid()
+	return true, true
+}
+
+// bind binds wildcard name to e if its type fits, a wildcard bound already only matches the same expression again
+func (m *matcher) bind(name string, wc weave.Wildcard, e ast.Expr) bool {
+	if b, ok := m.bound[name]; ok {
+		return types.ExprString(b) == types.ExprString(e)
+	}
+	if !m.typeOk(wc, e) {
+		return false
+	}
+	m.bound[name] = e
+	return true
+}
+
+// typeOk reports whether expression e has the type of wildcard wc, untyped constants have their default type. The
+// weave is written in the target package, its types are named without a package, those of imports by package name.
+func (m *matcher) typeOk(wc weave.Wildcard, e ast.Expr) bool {
+	if wc.Type == "interface{}" || wc.Type == "any" {
+		return true
+	}
+	var t types.Type
+	if tv, ok := m.p.info.Types[e]; ok && !tv.IsType() {
+		t = tv.Type
+	} else if id, ok := e.(*ast.Ident); ok && m.p.info.Uses[id] != nil {
+		t = m.p.info.Uses[id].Type()
+	}
+	if t == nil {
+		return false
+	}
+	qualifier := func(p *types.Package) string {
+		if p == m.p.types {
+			return ""
+		}
+		return p.Name()
+	}
+	return types.TypeString(types.Default(t), qualifier) == wc.Type
+}
+
+// subst copies pattern with its wildcards replaced by what they matched, the copy is placed at pos
+func (m *matcher) subst(pattern ast.Node, pos token.Pos) ast.Node {
+	return m.copy(reflect.ValueOf(pattern), pos, true).Interface().(ast.Node)
+}
+
+// copyNode deep copies n placing the copy at pos
+func copyNode(n ast.Node, pos token.Pos) ast.Node {
+	return (&matcher{}).subst(n, pos)
+}
+
+// copy deep copies v, expr tells whether v may be replaced by any expression rather than only an identifier
+func (m *matcher) copy(v reflect.Value, pos token.Pos, expr bool) reflect.Value {
+	if !v.IsValid() {
+		return v
+	}
+	if name, wc, ok := m.wildcard(v); ok && expr && !wc.Variadic {
+		if b, ok := m.bound[name]; ok {
+			return reflect.ValueOf(b)
+		}
+	}
+	switch v.Type() {
+	case objectType, scopeType, commentsType:
+		return reflect.Zero(v.Type())
+	case positionType:
+		if v.Interface().(token.Pos).IsValid() {
+			return reflect.ValueOf(pos)
+		}
+		return v
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type().Elem())
+		c.Elem().Set(m.copy(v.Elem(), pos, expr))
+		if call, ok := c.Interface().(*ast.CallExpr); ok {
+			m.expandVariadic(call, pos)
+		}
+		return c
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type()).Elem()
+		c.Set(m.copy(v.Elem(), pos, true))
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(m.copy(v.Index(i), pos, expr))
+		}
+		return c
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Field(i)
+			c.Field(i).Set(m.copy(f, pos, f.Kind() == reflect.Interface))
+		}
+		return c
+	}
+	return v
+}
+
+// expandVariadic replaces a variadic wildcard ending the arguments of call with the arguments it matched
+func (m *matcher) expandVariadic(call *ast.CallExpr, pos token.Pos) {
+	if len(call.Args) == 0 {
+		return
+	}
+	name, wc, ok := m.wildcard(reflect.ValueOf(call.Args[len(call.Args)-1]))
+	if !ok || !wc.Variadic {
+		return
+	}
+	rest, ok := m.rest[name]
+	if !ok {
+		return
+	}
+	call.Args = append(call.Args[:len(call.Args)-1], rest...)
+	call.Ellipsis = token.NoPos
+	if m.spread[name] {
+		call.Ellipsis = pos
+	}
+}
@@ -0,0 +1,97 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+)
+
+// ruleTarget mimics go-spew, whose functions take types of the package, of imports and variadic arguments
+const ruleTarget = `package target
+
+import (
+	"bytes"
+	"io"
+)
+
+type ConfigState struct{ Indent string }
+
+func fdump(c *ConfigState, w io.Writer, a ...interface{}) {}
+
+func (c *ConfigState) Sdump(a ...interface{}) string {
+	var buf bytes.Buffer
+	fdump(c, &buf, a...)
+	return buf.String()
+}
+
+func scale(n int) int { return n * 2 }
+
+func sum(xs ...int) int { return len(xs) }
+
+func use() int {
+	return scale(3) + sum(1, 2, 3) + scale(len("x"))
+}
+`
+
+func TestRuleWildcards(t *testing.T) {
+	tests := []struct {
+		name string
+		rule string
+		// want is the code the rule rewrites to, empty when the rule does not match
+		want string
+	}{
+		{
+			name: "type of the target package",
+			rule: "func typed(x *ConfigState) {\nbefore:\n\tfdump(x, &buf, a...)\nafter:\n\tfdump(x, &buf)\n}",
+			want: "fdump(c, &buf)",
+		},
+		{
+			name: "any type",
+			rule: "func typed(x interface{}) {\nbefore:\n\tfdump(x, &buf, a...)\nafter:\n\tfdump(x, &buf)\n}",
+			want: "fdump(c, &buf)",
+		},
+		{
+			name: "imported type",
+			rule: "func typed(x *ConfigState, b *bytes.Buffer, a ...interface{}) {\nbefore:\n\tfdump(x, b, a...)\nafter:\n\tfdump(x, b)\n}",
+			want: "fdump(c, &buf)",
+		},
+		{
+			name: "other type",
+			rule: "func typed(x *ConfigState, b *bytes.Reader, a ...interface{}) {\nbefore:\n\tfdump(x, b, a...)\nafter:\n\tfdump(x, b)\n}",
+		},
+		{
+			name: "untyped constant",
+			rule: "func double(n int) {\nbefore:\n\tscale(n)\nafter:\n\tn + n\n}",
+			want: "return 3 + 3 + sum(1, 2, 3) + (len(\"x\") + len(\"x\"))",
+		},
+		{
+			name: "untyped constant of another type",
+			rule: "func double(n float64) {\nbefore:\n\tscale(n)\nafter:\n\tn + n\n}",
+		},
+		{
+			name: "variadic",
+			rule: "func count(xs ...int) {\nbefore:\n\tsum(xs)\nafter:\n\tsum(0, xs)\n}",
+			want: "sum(0, 1, 2, 3)",
+		},
+		{
+			name: "variadic of another type",
+			rule: "func count(xs ...string) {\nbefore:\n\tsum(xs)\nafter:\n\tsum(0, xs)\n}",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			weave := "package target\n\nimport (\n\t\"bytes\"\n\t\"io\"\n)\n\n// +weaver rule\n" + tt.rule + "\n"
+			m, wp := weaveTarget(t, map[string]string{"target.go": ruleTarget}, map[string]string{"target.go": weave})
+			status := statuses(wp)
+			if tt.want == "" {
+				if !strings.Contains(status, "unmatched") {
+					t.Errorf("operations: %s want: unmatched", status)
+				}
+				return
+			}
+			if !strings.Contains(status, "applied") {
+				t.Errorf("operations: %s want: applied", status)
+			}
+			contains(t, m, "target.go", tt.want)
+		})
+	}
+}
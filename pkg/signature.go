@@ -0,0 +1,233 @@
+package pkg
+
+import (
+	log "github.com/sirupsen/logrus"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"golang.org/x/tools/go/ast/astutil"
+	"gweaver/weave"
+)
+
+// weaveSignatures gives the functions of the signature weaves declared in file f their new parameters and rewrites
+// the calls of f resolved by info to pass the arguments in the new order, with the defaults of the parameters added.
+// The declarations changed are marked touched. It returns the weave of the last change, nil if none was made.
+func (p *source) weaveSignatures(sigs []*weave.Signature, info *types.Info, f *ast.File) (w *weave.Weave) {
+	if len(sigs) == 0 {
+		return nil
+	}
+	fn := p.pkg.Fset.Position(f.Package).Filename
+	if info == nil {
+		log.Warnf("weaveSignatures: %s: no type information, its signatures are not changed", fn)
+		return nil
+	}
+	targets := make(map[string]*weave.Signature)
+	for _, s := range sigs {
+		targets[s.FullName()] = s
+	}
+
+	// called holds the identifiers of the functions called, any other use of a target cannot be rewritten
+	called := make(map[*ast.Ident]bool)
+	for _, d := range f.Decls {
+		if fd, ok := d.(*ast.FuncDecl); ok {
+			if obj, ok := info.Defs[fd.Name].(*types.Func); ok && targets[obj.FullName()] != nil {
+				s := targets[obj.FullName()]
+				p.changeParams(fd, obj, s, info)
+				p.touched[d] = true
+				s.Changed(paramNames(obj), obj.Type().(*types.Signature).Variadic())
+				w = s.Weave()
+			}
+		}
+		ast.Inspect(d, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			obj, recv := calledFunc(info, call)
+			if obj == nil {
+				return true
+			}
+			s, ok := targets[obj.FullName()]
+			if !ok {
+				return true
+			}
+			called[funcIdent(call.Fun)] = true
+			// A method expression such as (*T).M(t, ...) passes the receiver first
+			skip := 0
+			if recv == nil && obj.Type().(*types.Signature).Recv() != nil {
+				skip = 1
+			}
+			if !p.rewriteArgs(info, f, call, skip, obj, s) {
+				log.Warnf("weaveSignatures: %s: the call of: %s is left alone", p.pkg.Fset.Position(call.Pos()), s.Name)
+				return true
+			}
+			log.Debugf("weaveSignatures: %s: %s: call rewritten", p.pkg.Fset.Position(call.Pos()), s.Name)
+			p.touched[d] = true
+			w = s.Weave()
+			return true
+		})
+	}
+	for id, obj := range info.Uses {
+		if fo, ok := obj.(*types.Func); ok && targets[fo.FullName()] != nil && !called[id] && id.Pos() >= f.Pos() && id.Pos() < f.End() {
+			log.Warnf("weaveSignatures: %s: %s is used as a value, the use is not rewritten", p.pkg.Fset.Position(id.Pos()), fo.Name())
+		}
+	}
+	return
+}
+
+// funcIdent is the identifier naming the function a call expression calls
+func funcIdent(fun ast.Expr) *ast.Ident {
+	for {
+		switch t := fun.(type) {
+		case *ast.ParenExpr:
+			fun = t.X
+		case *ast.SelectorExpr:
+			return t.Sel
+		case *ast.Ident:
+			return t
+		case *ast.IndexExpr:
+			fun = t.X
+		case *ast.IndexListExpr:
+			fun = t.X
+		default:
+			return nil
+		}
+	}
+}
+
+// changeParams replaces the parameters of the declaration of function obj with those of signature s, reporting the
+// parameters it removes that the body still uses
+func (p *source) changeParams(fd *ast.FuncDecl, obj *types.Func, s *weave.Signature, info *types.Info) {
+	kept := make(map[string]bool)
+	for _, n := range s.ParamNames() {
+		kept[n] = true
+	}
+	params := obj.Type().(*types.Signature).Params()
+	for i := 0; i < params.Len(); i++ {
+		v := params.At(i)
+		if kept[v.Name()] || fd.Body == nil {
+			continue
+		}
+		for id, o := range info.Uses {
+			if o == v && id.Pos() >= fd.Body.Pos() && id.Pos() < fd.Body.End() {
+				log.Warnf("weaveSignatures: %s: parameter: %s of: %s is removed but still used", p.pkg.Fset.Position(id.Pos()), v.Name(), s.Name)
+				break
+			}
+		}
+	}
+	list := copyNode(s.Params, fd.Type.Params.Opening).(*ast.FieldList)
+	list.Opening, list.Closing = fd.Type.Params.Opening, fd.Type.Params.Closing
+	fd.Type.Params = list
+}
+
+// rewriteArgs rearranges the arguments of a call of function obj, after the first skip, for its new signature s. It
+// reports false, leaving the call alone, when the arguments cannot be matched to the parameters.
+func (p *source) rewriteArgs(info *types.Info, f *ast.File, call *ast.CallExpr, skip int, obj *types.Func, s *weave.Signature) bool {
+	params, variadic := paramNames(obj), obj.Type().(*types.Signature).Variadic()
+	if original, v, ok := s.Original(); ok {
+		params, variadic = original, v
+	} else if obj.Pkg() == nil || obj.Pkg().Path() != p.pkg.PkgPath {
+		log.Warnf("weaveSignatures: %s: the declaration of: %s was not changed", p.pkg.Fset.Position(call.Pos()), s.Name)
+		return false
+	}
+	args := call.Args[skip:]
+	n := len(params)
+	if len(args) == 1 && n > 1 && isTuple(info, args[0]) {
+		log.Warnf("weaveSignatures: %s: the arguments of: %s come from a single call", p.pkg.Fset.Position(call.Pos()), s.Name)
+		return false
+	}
+	byName := make(map[string][]ast.Expr)
+	for i, name := range params {
+		if name == "" || name == "_" {
+			log.Warnf("weaveSignatures: %s has unnamed parameters, they cannot be matched by name", s.Name)
+			return false
+		}
+		switch {
+		case variadic && i == n-1 && !call.Ellipsis.IsValid() && i <= len(args):
+			byName[name] = args[i:]
+		case i < len(args):
+			byName[name] = args[i : i+1]
+		}
+	}
+
+	names := s.ParamNames()
+	var out []ast.Expr
+	ellipsis := false
+	for i, name := range names {
+		last := i == len(names)-1
+		if a, ok := byName[name]; ok {
+			switch {
+			case !variadic || name != params[n-1]:
+			case last && s.Variadic():
+				// The variadic parameter stays variadic, a slice passed with ... still is
+				ellipsis = call.Ellipsis.IsValid()
+			case !call.Ellipsis.IsValid():
+				// The arguments of a variadic parameter that is no longer variadic go into a slice
+				t := copyNode(s.ParamType(name), call.Lparen).(ast.Expr)
+				a = []ast.Expr{&ast.CompositeLit{Type: t, Lbrace: call.Lparen, Elts: a, Rbrace: call.Lparen}}
+			}
+			out = append(out, a...)
+			continue
+		}
+		if d, ok := s.Defaults[name]; ok {
+			out = append(out, p.defaultArg(info, f, d, s, obj.Pkg(), call.Rparen))
+			continue
+		}
+		if !last || !s.Variadic() {
+			log.Warnf("weaveSignatures: %s: no default for the parameter: %s of: %s", p.pkg.Fset.Position(call.Pos()), name, s.Name)
+			return false
+		}
+	}
+	call.Args = append(call.Args[:skip:skip], out...)
+	if !ellipsis {
+		call.Ellipsis = 0
+	}
+	return true
+}
+
+// isTuple reports whether e is a call returning several values
+func isTuple(info *types.Info, e ast.Expr) bool {
+	tv, ok := info.Types[e]
+	if !ok {
+		return false
+	}
+	_, ok = tv.Type.(*types.Tuple)
+	return ok
+}
+
+// paramNames lists the names of the parameters of function obj
+func paramNames(obj *types.Func) (names []string) {
+	params := obj.Type().(*types.Signature).Params()
+	for i := 0; i < params.Len(); i++ {
+		names = append(names, params.At(i).Name())
+	}
+	return
+}
+
+// defaultArg copies the default expression d of signature s for file f. The packages the weave imports are imported by
+// f and the identifiers of package target, the function's, are qualified when f belongs to another package.
+func (p *source) defaultArg(info *types.Info, f *ast.File, d ast.Expr, s *weave.Signature, target *types.Package, pos token.Pos) ast.Expr {
+	e := copyNode(d, pos).(ast.Expr)
+	foreign := target.Path() != p.pkg.PkgPath
+	var imports []string
+	result := astutil.Apply(e, func(c *astutil.Cursor) bool {
+		switch t := c.Node().(type) {
+		case *ast.SelectorExpr:
+			if x, ok := t.X.(*ast.Ident); ok {
+				if path, ok := s.ImportPath(x.Name); ok {
+					c.Replace(p.qualified(info, f, path, t.Sel.Name, pos))
+					imports = append(imports, path)
+					return false
+				}
+			}
+		case *ast.Ident:
+			if foreign && c.Name() != "Sel" && c.Name() != "Key" && target.Scope().Lookup(t.Name) != nil && t.Name != "_" {
+				c.Replace(p.qualified(info, f, target.Path(), t.Name, pos))
+				imports = append(imports, target.Path())
+			}
+		}
+		return true
+	}, nil)
+	p.mgr.requireImports(imports)
+	return result.(ast.Expr)
+}
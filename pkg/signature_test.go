@@ -0,0 +1,78 @@
+package pkg
+
+import (
+	"gweaver/weave"
+	"path"
+	"testing"
+)
+
+// signatureTarget calls a function and a method whose parameters the weaves change
+const signatureTarget = `package target
+
+import "fmt"
+
+type Client struct{ name string }
+
+func (c *Client) Do(req string, retries int) string { return fmt.Sprint(c.name, req) }
+
+func greet(greeting string, name string) string { return greeting + name }
+
+func use(c *Client) string {
+	return c.Do("get", 3) + greet("hi ", "bob")
+}
+`
+
+func TestWeaveSignatures(t *testing.T) {
+	tests := []struct {
+		name  string
+		weave string
+		want  []string
+	}{
+		{
+			name:  "add a parameter with a default",
+			weave: "package target\n\n// +weaver signature\nfunc greet(greeting string, name string, punct string) string {\n\tpunct = \"!\"\n}\n",
+			want:  []string{"func greet(greeting string, name string, punct string) string {", `greet("hi ", "bob", "!")`},
+		},
+		{
+			name:  "add a parameter whose default is imported",
+			weave: "package target\n\nimport \"context\"\n\n// +weaver signature\nfunc (c *Client) Do(ctx context.Context, req string, retries int) string {\n\tctx = context.Background()\n}\n",
+			want:  []string{"\"context\"", "func (c *Client) Do(ctx context.Context, req string, retries int) string {", `c.Do(context.Background(), "get", 3)`},
+		},
+		{
+			name:  "remove a parameter",
+			weave: "package target\n\n// +weaver signature\nfunc (c *Client) Do(req string) string {}\n",
+			want:  []string{"func (c *Client) Do(req string) string {", `c.Do("get")`},
+		},
+		{
+			name:  "reorder the parameters",
+			weave: "package target\n\n// +weaver signature\nfunc greet(name string, greeting string) string {}\n",
+			want:  []string{"func greet(name string, greeting string) string { return greeting + name }", `greet("bob", "hi ")`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, wp := weaveTarget(t, map[string]string{"target.go": signatureTarget}, map[string]string{"target.go": tt.weave})
+			if s := statuses(wp); s != "signature "+wp.Report()[0].Name+": applied" {
+				t.Errorf("operations: %s", s)
+			}
+			contains(t, m, "target.go", tt.want...)
+		})
+	}
+}
+
+func TestWeaveSignaturesMain(t *testing.T) {
+	dep := path.Join(testModule, "dep")
+	writeModule(t, map[string]string{
+		"dep/dep.go":                    "package dep\n\nfunc Greet(greeting string, name string) string { return greeting + name }\n",
+		"app/app.go":                    "package app\n\nimport \"" + dep + "\"\n\nfunc Hello() string { return dep.Greet(\"hi \", \"bob\") }\n",
+		path.Join("ext", dep, "dep.go"): "package dep\n\n// +weaver signature main\nfunc Greet(name string, greeting string) string {}\n",
+	})
+	m, wp := weavePackage(t, dep, nil)
+	contains(t, m, "dep.go", "func Greet(name string, greeting string) string")
+	callers := wp.MainSignatures()
+	if len(callers) != 1 {
+		t.Fatalf("main signatures: %d want: 1", len(callers))
+	}
+	m, _ = weavePackage(t, path.Join(testModule, "app"), []*weave.Signature{callers[0]})
+	contains(t, m, "app.go", `dep.Greet("bob", "hi ")`)
+}
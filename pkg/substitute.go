@@ -0,0 +1,93 @@
+package pkg
+
+import (
+	log "github.com/sirupsen/logrus"
+	"go/ast"
+	"go/types"
+	"golang.org/x/tools/go/ast/astutil"
+	"gweaver/weave"
+)
+
+// weaveSubstitutes swaps the types of the substitute weaves for their replacements in file f, wherever info says a
+// type expression denotes one of them. The declarations holding them are marked touched. It returns the weave of the
+// last type swapped, nil if none was.
+func (p *source) weaveSubstitutes(subs []*weave.Substitute, info *types.Info, f *ast.File) (w *weave.Weave) {
+	if len(subs) == 0 {
+		return nil
+	}
+	fn := p.pkg.Fset.Position(f.Package).Filename
+	if info == nil {
+		log.Warnf("weaveSubstitutes: %s: no type information, its types are not substituted", fn)
+		return nil
+	}
+	targets := make(map[string]*weave.Substitute)
+	for _, s := range subs {
+		targets[s.Target] = s
+	}
+	// target returns the substitution of the type e denotes, if any
+	target := func(e ast.Expr) (*weave.Substitute, string) {
+		tv, ok := info.Types[e]
+		if !ok || !tv.IsType() {
+			return nil, ""
+		}
+		named, ok := tv.Type.(*types.Named)
+		if !ok || named.Obj().Pkg() == nil || named.TypeArgs().Len() > 0 {
+			return nil, ""
+		}
+		return targets[named.Obj().Pkg().Path()+"."+named.Obj().Name()], named.Obj().Name()
+	}
+
+	// unused holds the packages of substituted types, their imports may no longer be needed
+	unused := make(map[string]bool)
+	var imports []string
+	for _, d := range f.Decls {
+		var recv *ast.FieldList
+		if fd, ok := d.(*ast.FuncDecl); ok {
+			recv = fd.Recv
+		}
+		astutil.Apply(d, func(c *astutil.Cursor) bool {
+			switch n := c.Node().(type) {
+			case *ast.FieldList:
+				// A method stays on the type it is declared on
+				return n != recv
+			case *ast.Field:
+				// An embedded field is named after its type, renaming it would break the selectors using it
+				if len(n.Names) > 0 {
+					return true
+				}
+				t := n.Type
+				if st, ok := t.(*ast.StarExpr); ok {
+					t = st.X
+				}
+				if s, name := target(t); s != nil && s.Type != name {
+					log.Warnf("weaveSubstitutes: %s: %s: embedded %s left alone, the replacement has to be named: %s", fn, p.pkg.Fset.Position(n.Pos()), s.Target, name)
+					return false
+				}
+				return true
+			case ast.Expr:
+				s, _ := target(n)
+				if s == nil {
+					return true
+				}
+				unused[info.Types[n].Type.(*types.Named).Obj().Pkg().Path()] = true
+				c.Replace(p.qualified(info, f, s.Path, s.Type, n.Pos()))
+				if s.Path != "" {
+					imports = append(imports, s.Path)
+				}
+				log.Debugf("weaveSubstitutes: %s: %s: %s substituted by: %s", fn, p.pkg.Fset.Position(n.Pos()), s.Target, s.Type)
+				p.touched[d] = true
+				s.Substituted()
+				w = s.Weave()
+				return false
+			}
+			return true
+		}, nil)
+	}
+	for i := range unused {
+		if dropUnusedImport(p.pkg.Fset, f, i) {
+			p.touchImports()
+		}
+	}
+	p.mgr.requireImports(imports)
+	return
+}
@@ -0,0 +1,41 @@
+package pkg
+
+import "testing"
+
+func TestWeaveSubstitutes(t *testing.T) {
+	tests := []struct {
+		name  string
+		weave string
+		// status is the outcome of the operations, want what the woven file holds and imports what it requires
+		status  string
+		want    []string
+		imports []string
+	}{
+		{
+			name:   "type of the weave",
+			weave:  "import \"strings\"\n\n// +weaver substitute strings.Builder\ntype recBuilder struct{ strings.Builder }\n",
+			status: "insert recBuilder: applied, substitute strings.Builder: applied",
+			want:   []string{"type recBuilder struct{ strings.Builder }\n", "\tvar b recBuilder\n"},
+		},
+		{
+			name:    "type of another package",
+			weave:   "// +weaver substitute strings.Builder bytes.Buffer\n",
+			status:  "substitute strings.Builder: applied",
+			want:    []string{"import (\n\t\"bytes\"\n\t\"strings\"\n)\n", "\tvar b bytes.Buffer\n"},
+			imports: []string{"bytes"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, wp := weaveTarget(t, map[string]string{"target.go": callsiteTarget}, map[string]string{"target.go": "package target\n\n" + tt.weave})
+			if s := statuses(wp); s != tt.status {
+				t.Errorf("operations: %s want: %s", s, tt.status)
+			}
+			contains(t, m, "target.go", tt.want...)
+			lacks(t, m, "target.go", "var b strings.Builder")
+			if len(m.imports) != len(tt.imports) || (len(tt.imports) > 0 && m.imports[0] != tt.imports[0]) {
+				t.Errorf("required imports: %v want: %v", m.imports, tt.imports)
+			}
+		})
+	}
+}
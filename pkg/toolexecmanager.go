@@ -0,0 +1,152 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	log "github.com/sirupsen/logrus"
+	"gweaver/weave"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ToolexecManager weaves the files of a single compile invocation under go build -toolexec. The woven files go to a
+// temporary directory and are handed to the compiler in place of the originals, nothing else is written.
+type ToolexecManager struct {
+	dir string
+	// importcfg is the compiler's -importcfg file, it lists the packages the compiled package may import
+	importcfg string
+	version   string
+	// replace maps the files the weaves changed to their woven copies
+	replace map[string]string
+	// added are the files the weaves generated, they have no original
+	added []string
+}
+
+// moduleVersionRE finds the version of a module cache path, e.g. /go/pkg/mod/github.com/x/y@v1.2.3/z.go
+var moduleVersionRE = regexp.MustCompile(`@(v[^/\\]+)[/\\]`)
+
+func NewToolexecManager(dir string, importcfg string) (m *ToolexecManager) {
+	return &ToolexecManager{dir: dir, importcfg: importcfg, replace: make(map[string]string)}
+}
+
+// setup finds the version of the package from where its files are, the compiler is not told
+func (m *ToolexecManager) setup(s *source) {
+	if len(s.pkg.GoFiles) == 0 {
+		return
+	}
+	fn := s.pkg.GoFiles[0]
+	switch {
+	case IsStdlib(s.pkg.PkgPath) && strings.HasPrefix(fn, toolEnv("GOROOT")):
+		m.version = "v" + strings.TrimPrefix(toolEnv("GOVERSION"), "go")
+	default:
+		if v := moduleVersionRE.FindStringSubmatch(filepath.ToSlash(fn)); v != nil {
+			m.version = v[1]
+		}
+	}
+	log.Debugf("toolexecmanager.setup: package: %s version: %s", s.pkg.PkgPath, m.version)
+}
+
+// toolEnv returns a go env variable as the go command sets it in the environment of the tools it runs, go env only
+// runs when weaver is not run by the go command
+func toolEnv(name string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return goEnv(name)
+}
+
+// writeWovenFile writes a file the weaves changed to the temporary directory, unchanged files are compiled as-is
+func (m *ToolexecManager) writeWovenFile(content []byte, plain []byte, fn string) {
+	original, err := ioutil.ReadFile(fn)
+	if err == nil && bytes.Equal(original, content) {
+		return
+	}
+	if err != nil {
+		m.added = append(m.added, fn)
+	}
+	fqn := filepath.Join(m.dir, filepath.Base(fn))
+	// The woven file is deleted after the compile, positions before its first //line directive map to the original
+	content = append([]byte("//line "+m.wovenName(fn)+":1\n"), content...)
+	if err := ioutil.WriteFile(fqn, content, 0644); err != nil {
+		log.Fatalf("toolexecmanager.writeWovenFile: error writing file: %s err: %+v", fqn, err)
+	}
+	m.replace[fn] = fqn
+}
+
+// requireImports checks the weave imports against the compiler's import config, the go command only builds the
+// dependencies the original package imports
+func (m *ToolexecManager) requireImports(imports []string) {
+	if m.importcfg == "" || len(imports) == 0 {
+		return
+	}
+	f, err := os.Open(m.importcfg)
+	if err != nil {
+		log.Errorf("toolexecmanager.requireImports: error reading: %s err: %+v", m.importcfg, err)
+		return
+	}
+	defer f.Close()
+	known := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimPrefix(scanner.Text(), "packagefile ")
+		if i := strings.IndexByte(line, '='); i > 0 {
+			known[line[:i]] = true
+		}
+	}
+	for _, i := range imports {
+		if !known[i] {
+			log.Errorf("toolexecmanager.requireImports: weave import: %s is not a dependency of the package, it cannot be compiled under -toolexec", i)
+		}
+	}
+}
+
+func (m *ToolexecManager) recordWoven(fn string, w *weave.Weave) {
+	log.Debugf("toolexecmanager.recordWoven: %s woven by: %s", fn, w.Filename())
+}
+
+// wovenName is the name of the original, the woven copy only lives for the compile
+func (m *ToolexecManager) wovenName(fn string) string {
+	return sourceName(fn)
+}
+
+func (m *ToolexecManager) targetVersion() string {
+	return m.version
+}
+
+// moduleVersionOk checks the version of the package being compiled against a weave's constraint, no constraint
+// accepts any version
+func (m *ToolexecManager) moduleVersionOk(c *weave.Constraint) bool {
+	if c == nil {
+		return true
+	}
+	if m.version == "" {
+		log.Warnf("toolexecmanager.moduleVersionOk: no version to check against: %s", c)
+		return false
+	}
+	return c.Check(m.version)
+}
+
+// Replace returns the file to compile in place of fn
+func (m *ToolexecManager) Replace(fn string) string {
+	if r, ok := m.replace[fn]; ok {
+		return r
+	}
+	return fn
+}
+
+// Files returns the files to compile in place of files, along with the ones the weaves generated. They are sorted by
+// name like the go command sorts them, the compiler runs the init functions in the order of its files.
+func (m *ToolexecManager) Files(files []string) []string {
+	all := append(append([]string(nil), files...), m.added...)
+	if len(m.added) > 0 {
+		sort.SliceStable(all, func(i, j int) bool { return filepath.Base(all[i]) < filepath.Base(all[j]) })
+	}
+	for i, fn := range all {
+		all[i] = m.Replace(fn)
+	}
+	return all
+}
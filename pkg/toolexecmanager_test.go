@@ -0,0 +1,39 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestToolexecManagerFiles(t *testing.T) {
+	src, tmp := t.TempDir(), t.TempDir()
+	a, b := filepath.Join(src, "a.go"), filepath.Join(src, "b.go")
+	for _, fn := range []string{a, b} {
+		if err := ioutil.WriteFile(fn, []byte("package p\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := NewToolexecManager(tmp, "")
+	m.writeWovenFile([]byte("package p\n"), nil, a)
+	m.writeWovenFile([]byte("package p\n\nfunc woven() {}\n"), nil, b)
+	// The files of init functions running first and last are generated
+	m.writeWovenFile([]byte("package p\n\nfunc init() {}\n"), nil, filepath.Join(src, "zz_gweaver_init.go"))
+	m.writeWovenFile([]byte("package p\n\nfunc init() {}\n"), nil, filepath.Join(src, "00_gweaver_init.go"))
+
+	got := m.Files([]string{a, b})
+	want := []string{filepath.Join(tmp, "00_gweaver_init.go"), a, filepath.Join(tmp, "b.go"), filepath.Join(tmp, "zz_gweaver_init.go")}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("files: %v want: %v", got, want)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(tmp, "b.go"))
+	if err != nil || !strings.HasPrefix(string(content), "//line "+b+":1\n") {
+		t.Errorf("woven b.go does not map to the original err: %v\n%s", err, content)
+	}
+	// Without generated files the go command's order is kept
+	m = NewToolexecManager(tmp, "")
+	if got := m.Files([]string{b, a}); strings.Join(got, " ") != b+" "+a {
+		t.Errorf("files: %v want: %v", got, []string{b, a})
+	}
+}
@@ -0,0 +1,76 @@
+package weave
+
+import (
+	log "github.com/sirupsen/logrus"
+	"go/ast"
+	"strings"
+)
+
+// CallSite redirects the calls of a function or method to an advice function taking the same arguments, a method's
+// receiver comes first. The advice is either a function of the weave, woven into its target file, or a function of
+// another package:
+//
+//	// +weaver callsite net/http.Get
+//	func tracedGet(url string) (*http.Response, error)
+//
+//	// +weaver callsite (*net/http.Client).Do example.com/trace.Do
+type CallSite struct {
+	w *Weave
+	// Target is the full name of the function or method whose calls are redirected, see types.Func.FullName
+	Target string
+	// Path is the import path of the advice, empty when the advice is woven into the package
+	Path   string
+	Advice string
+	// decl is the advice function of the weave
+	decl ast.Node
+}
+
+// addCallSite records a callsite operation. On a function of the weave the single argument is the target and the
+// function, inserted like any other, is the advice. As a file annotation the arguments are the target and the
+// advice's full name.
+func (w *Weave) addCallSite(args []string, fd *ast.FuncDecl, n *ast.Node) {
+	cs := &CallSite{w: w}
+	switch {
+	case fd != nil && len(args) == 1:
+		cs.Target, cs.Advice, cs.decl = args[0], fd.Name.Name, fd
+		w.inserts[fd.Name.Name] = n
+	case fd == nil && len(args) == 2:
+		var ok bool
+		cs.Target = args[0]
+		if cs.Path, cs.Advice, ok = splitFullName(args[1]); !ok {
+			log.Fatalf("addCallSite: %s: invalid advice, expected a package path and function: %s", w.filename, args[1])
+		}
+	default:
+		log.Fatalf("addCallSite: %s: invalid callsite annotation: %s", w.filename, strings.Join(args, " "))
+	}
+	w.callSites = append(w.callSites, cs)
+}
+
+// Weave is the weave the call site belongs to
+func (cs *CallSite) Weave() *Weave {
+	return cs.w
+}
+
+// Redirected records that a call of the target now goes to the advice
+func (cs *CallSite) Redirected() {
+	cs.w.match(callSite, cs.Target)
+}
+
+// CallSites lists the callsite operations of the selected weaves, they apply to every file of the package
+func (w *Pkg) CallSites() (r []*CallSite) {
+	for _, ww := range w.selected {
+		if !ww.skipped {
+			r = append(r, ww.callSites...)
+		}
+	}
+	return
+}
+
+// splitFullName splits a package level name such as net/http.Client into its package path and name
+func splitFullName(s string) (path string, name string, ok bool) {
+	i := strings.LastIndex(s, ".")
+	if i <= strings.LastIndex(s, "/") || i == len(s)-1 {
+		return "", "", false
+	}
+	return s[:i], s[i+1:], true
+}
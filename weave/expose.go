@@ -0,0 +1,80 @@
+package weave
+
+import (
+	log "github.com/sirupsen/logrus"
+	"go/token"
+	"strings"
+)
+
+// Expose makes an unexported declaration of the target package reachable from other packages without touching it.
+// Exported wrappers of functions and methods, aliases of types, constants of constants and getters and setters of
+// variables and struct fields are generated into a file of their own. It is a file annotation:
+//
+//	// +weaver expose dial
+//	// +weaver expose (*Client).timeout as Deadline
+//
+// The exported name defaults to the name with its first letter upper cased.
+type Expose struct {
+	w *Weave
+	// Name is the declaration exposed, methods and fields are written (*T).m or T.m
+	Name string
+	As   string
+}
+
+// Expose arguments
+const (
+	exposeOp string = "expose"
+	exposeAs string = "as"
+)
+
+// addExpose records an expose file annotation
+func (w *Weave) addExpose(args []string) {
+	e := &Expose{w: w}
+	switch {
+	case len(args) == 1:
+		e.Name = args[0]
+	case len(args) == 3 && args[1] == exposeAs && token.IsExported(args[2]) && token.IsIdentifier(args[2]):
+		e.Name, e.As = args[0], args[2]
+	default:
+		log.Fatalf("addExpose: %s: invalid arguments: %s, expected: name [as ExportedName]", w.filename, strings.Join(args, " "))
+	}
+	w.exposes = append(w.exposes, e)
+}
+
+// Member splits the name of a method or field into its type and member, ok is false for package level names
+func (e *Expose) Member() (typ string, member string, ok bool) {
+	i := strings.Index(e.Name, ".")
+	if i < 0 {
+		return "", e.Name, false
+	}
+	return strings.Trim(e.Name[:i], "(*)"), e.Name[i+1:], true
+}
+
+// Exported is the name the declaration is exposed as
+func (e *Expose) Exported() string {
+	if e.As != "" {
+		return e.As
+	}
+	_, name, _ := e.Member()
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+// Weave is the weave the expose belongs to
+func (e *Expose) Weave() *Weave {
+	return e.w
+}
+
+// Exposed records that the exported declarations were generated
+func (e *Expose) Exposed() {
+	e.w.match(exposeOp, e.Name)
+}
+
+// Exposes lists the expose operations of the selected weaves
+func (w *Pkg) Exposes() (r []*Expose) {
+	for _, ww := range w.selected {
+		if !ww.skipped {
+			r = append(r, ww.exposes...)
+		}
+	}
+	return
+}
@@ -0,0 +1,300 @@
+package weave
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go/ast"
+	"strconv"
+	"strings"
+)
+
+// FieldOp changes a single field of a struct the weave does not replace as a whole, the rest of the struct is left
+// alone. The struct is annotated with `// +weaver fields` and each field of the weave's copy with its operation:
+//
+//	// +weaver fields
+//	type Config struct {
+//		Timeout time.Duration `json:"timeout"` // +weaver insert after Retries
+//		Legacy  string                         // +weaver delete
+//		Port    int64                          // +weaver type
+//		Name    string `json:"name,omitempty"` // +weaver tag -yaml
+//	}
+//
+// insert adds the field at the end of the struct, after or before another field or first. type gives the field the
+// weave's type. tag adds or edits the keys of the weave's tag and removes the keys given as -key.
+//
+// The methods of an interface annotated with `// +weaver methods` are inserted, deleted or given a new signature the
+// same way. `// +weaver methods stubs` adds stubs of the new methods to the types of the package implementing it.
+type FieldOp struct {
+	w      *Weave
+	Op     string
+	Struct string
+	Field  string
+	// Where is after, before or first for an insert placed relative to Anchor, empty for the end of the struct
+	Where  string
+	Anchor string
+	// RemoveTags lists the tag keys a tag operation removes
+	RemoveTags []string
+	node       *ast.Field
+}
+
+// Field operations besides insert and delete
+const (
+	fieldType        string = "type"
+	fieldTag         string = "tag"
+	structFields     string = "fields"
+	interfaceMethods string = "methods"
+)
+
+// addFields records the field operations of struct type ts of the weave, or the method operations of interface type
+// ts. With stubs the methods an interface gains are stubbed for the types of the package implementing it.
+func (w *Weave) addFields(ts *ast.TypeSpec, op string, args []string) {
+	var list *ast.FieldList
+	switch t := ts.Type.(type) {
+	case *ast.StructType:
+		if op == structFields {
+			list = t.Fields
+		}
+	case *ast.InterfaceType:
+		if op == interfaceMethods {
+			list = t.Methods
+		}
+	}
+	if list == nil {
+		what := "struct"
+		if op == interfaceMethods {
+			what = "interface"
+		}
+		log.Fatalf("addFields: %s: %s annotation on: %s which is not a %s", w.filename, op, ts.Name.Name, what)
+	}
+	for _, a := range args {
+		if op != interfaceMethods || a != "stubs" {
+			log.Fatalf("addFields: %s: %s: unknown argument: %s", w.filename, ts.Name.Name, a)
+		}
+		w.stubs[ts.Name.Name] = true
+	}
+	for _, f := range list.List {
+		op, args, ok := w.fieldAnnotation(f)
+		if !ok {
+			log.Warnf("addFields: %s: %s.%s has no field operation, it is ignored", w.filename, ts.Name.Name, FieldName(f))
+			continue
+		}
+		fo := &FieldOp{w: w, Op: op, Struct: ts.Name.Name, Field: FieldName(f), node: f}
+		switch {
+		case op == insert && len(args) == 1 && args[0] == "first":
+			fo.Where = args[0]
+		case op == insert && len(args) == 2 && (args[0] == "after" || args[0] == "before"):
+			fo.Where, fo.Anchor = args[0], args[1]
+		case op == fieldTag && list == structList(ts):
+			for _, a := range args {
+				if !strings.HasPrefix(a, "-") || len(a) == 1 {
+					log.Fatalf("addFields: %s: %s.%s: invalid tag argument: %s, expected -key", w.filename, fo.Struct, fo.Field, a)
+				}
+				fo.RemoveTags = append(fo.RemoveTags, a[1:])
+			}
+		case len(args) > 0:
+			log.Fatalf("addFields: %s: %s.%s: invalid arguments for %s: %s", w.filename, fo.Struct, fo.Field, op, strings.Join(args, " "))
+		}
+		w.fields[ts.Name.Name] = append(w.fields[ts.Name.Name], fo)
+	}
+}
+
+// structList returns the fields of a struct type, nil for any other type
+func structList(ts *ast.TypeSpec) *ast.FieldList {
+	if st, ok := ts.Type.(*ast.StructType); ok {
+		return st.Fields
+	}
+	return nil
+}
+
+// Stubs reports whether the implementers of interface name get stubs for the methods the weave adds
+func (w *Weave) Stubs(name string) bool {
+	return w.stubs[name]
+}
+
+// fieldAnnotation finds the operation of a field in its doc or line comment
+func (w *Weave) fieldAnnotation(f *ast.Field) (op string, args []string, ok bool) {
+	for _, cg := range []*ast.CommentGroup{f.Doc, f.Comment} {
+		if cg == nil {
+			continue
+		}
+		for _, c := range cg.List {
+			if op, args, ok = w.parseComment(c); ok {
+				switch op {
+				case insert, delete, fieldType, fieldTag:
+					return
+				}
+				return op, nil, false
+			}
+		}
+	}
+	return nop, nil, false
+}
+
+// FieldName is the name of a field, its first name or, embedded, the name of its type
+func FieldName(f *ast.Field) string {
+	if len(f.Names) > 0 {
+		return f.Names[0].Name
+	}
+	t := f.Type
+	if st, ok := t.(*ast.StarExpr); ok {
+		t = st.X
+	}
+	switch tt := t.(type) {
+	case *ast.Ident:
+		return tt.Name
+	case *ast.SelectorExpr:
+		return tt.Sel.Name
+	}
+	return ""
+}
+
+// GetFields returns the field operations on struct type n
+func (w *Weave) GetFields(n ast.Node) (ops []*FieldOp, ok bool) {
+	ts, ok := n.(*ast.TypeSpec)
+	if !ok {
+		return nil, false
+	}
+	ops, ok = w.fields[w.pkg.oldName(ts.Name)]
+	return
+}
+
+// name is the field operation's name in reports
+func (fo *FieldOp) name() string {
+	return fo.Struct + "." + fo.Field
+}
+
+// Applied records that the field operation changed its struct
+func (fo *FieldOp) Applied() {
+	fo.w.match(fo.Op, fo.name())
+}
+
+// Print formats the weave's field with its comments but the +weaver annotations, go/printer does not print fields
+// on their own
+func (fo *FieldOp) Print() []byte {
+	var buf bytes.Buffer
+	f := fo.node
+	if doc := fo.w.withoutAnnotations(f.Doc); doc != nil {
+		for _, c := range doc.List {
+			buf.WriteString(c.Text + "\n")
+		}
+	}
+	for i, n := range f.Names {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(n.Name)
+	}
+	if len(f.Names) > 0 && !fo.Method() {
+		buf.WriteString(" ")
+	}
+	buf.Write(fo.Type())
+	if f.Tag != nil {
+		buf.WriteString(" " + f.Tag.Value)
+	}
+	if comment := fo.w.withoutAnnotations(f.Comment); comment != nil {
+		for _, c := range comment.List {
+			buf.WriteString(" " + c.Text)
+		}
+	}
+	return buf.Bytes()
+}
+
+// Type formats the weave's type of the field, for an interface method its signature without func
+func (fo *FieldOp) Type() []byte {
+	if fo.Method() {
+		return bytes.TrimPrefix(fo.w.Print(fo.node.Type), []byte("func"))
+	}
+	return fo.w.Print(fo.node.Type)
+}
+
+// Method reports whether the operation is on a method of an interface rather than on a field or embedded interface
+func (fo *FieldOp) Method() bool {
+	_, ok := fo.node.Type.(*ast.FuncType)
+	return ok && len(fo.node.Names) == 1
+}
+
+// Tag merges the weave's tag into the original tag literal, which is empty when the field has none. It returns an
+// empty tag when no key is left.
+func (fo *FieldOp) Tag(original string) (string, error) {
+	keys, values, err := parseTag(original)
+	if err != nil {
+		return "", err
+	}
+	var wt string
+	if fo.node.Tag != nil {
+		wt = fo.node.Tag.Value
+	}
+	wkeys, wvalues, err := parseTag(wt)
+	if err != nil {
+		return "", err
+	}
+	for _, k := range wkeys {
+		if _, ok := values[k]; !ok {
+			keys = append(keys, k)
+		}
+		values[k] = wvalues[k]
+	}
+	var kept []string
+	for _, k := range keys {
+		removed := false
+		for _, r := range fo.RemoveTags {
+			removed = removed || r == k
+		}
+		if !removed {
+			kept = append(kept, fmt.Sprintf("%s:%s", k, strconv.Quote(values[k])))
+		}
+	}
+	if len(kept) == 0 {
+		return "", nil
+	}
+	tag := strings.Join(kept, " ")
+	if strings.Contains(tag, "`") {
+		return strconv.Quote(tag), nil
+	}
+	return "`" + tag + "`", nil
+}
+
+// parseTag splits a struct tag literal into its keys, in order, and their values, see reflect.StructTag
+func parseTag(lit string) (keys []string, values map[string]string, err error) {
+	values = make(map[string]string)
+	if lit == "" {
+		return
+	}
+	tag, err := strconv.Unquote(lit)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid struct tag: %s", lit)
+	}
+	for {
+		tag = strings.TrimLeft(tag, " ")
+		if tag == "" {
+			return
+		}
+		i := strings.Index(tag, ":\"")
+		if i <= 0 || strings.ContainsAny(tag[:i], " \"") {
+			return nil, nil, fmt.Errorf("invalid struct tag: %s", lit)
+		}
+		key := tag[:i]
+		tag = tag[i+1:]
+		// The value is a Go string literal, find its closing quote
+		j := 1
+		for j < len(tag) && tag[j] != '"' {
+			if tag[j] == '\\' {
+				j++
+			}
+			j++
+		}
+		if j >= len(tag) {
+			return nil, nil, fmt.Errorf("invalid struct tag: %s", lit)
+		}
+		value, err := strconv.Unquote(tag[:j+1])
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid struct tag: %s", lit)
+		}
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+		}
+		values[key] = value
+		tag = tag[j+1:]
+	}
+}
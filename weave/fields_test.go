@@ -0,0 +1,52 @@
+package weave
+
+import (
+	"go/ast"
+	"go/token"
+	"testing"
+)
+
+func TestFieldOpTag(t *testing.T) {
+	tests := []struct {
+		name     string
+		original string
+		weave    string
+		remove   []string
+		want     string
+	}{
+		{"add to none", "", "`json:\"name\"`", nil, "`json:\"name\"`"},
+		{"add a key", "`json:\"name\"`", "`db:\"name\"`", nil, "`json:\"name\" db:\"name\"`"},
+		{"edit a key in place", "`json:\"name\" db:\"n\"`", "`json:\"name,omitempty\"`", nil, "`json:\"name,omitempty\" db:\"n\"`"},
+		{"remove a key", "`json:\"name\" yaml:\"name\"`", "", []string{"yaml"}, "`json:\"name\"`"},
+		{"remove the last key", "`json:\"name\"`", "", []string{"json"}, ""},
+		{"edit and remove", "`json:\"a\" yaml:\"a\" db:\"a\"`", "`db:\"b\"`", []string{"json"}, "`yaml:\"a\" db:\"b\"`"},
+		{"interpreted literal", "\"json:\\\"name\\\"\"", "`xml:\"name\"`", nil, "`json:\"name\" xml:\"name\"`"},
+		{"value with a back quote", "", "\"doc:\\\"a`b\\\"\"", nil, "\"doc:\\\"a`b\\\"\""},
+		{"escaped quote in a value", "`doc:\"say \\\"hi\\\"\"`", "`json:\"-\"`", nil, "`doc:\"say \\\"hi\\\"\" json:\"-\"`"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &ast.Field{}
+			if tt.weave != "" {
+				f.Tag = &ast.BasicLit{Kind: token.STRING, Value: tt.weave}
+			}
+			fo := &FieldOp{Op: fieldTag, RemoveTags: tt.remove, node: f}
+			got, err := fo.Tag(tt.original)
+			if err != nil {
+				t.Fatalf("Tag(%s) err: %v", tt.original, err)
+			}
+			if got != tt.want {
+				t.Errorf("Tag(%s) = %s want: %s", tt.original, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFieldOpTagErrors(t *testing.T) {
+	for _, original := range []string{"`json`", "`json:name`", "`json:\"name`", "`:\"x\"`", "json"} {
+		fo := &FieldOp{Op: fieldTag, node: &ast.Field{}}
+		if _, err := fo.Tag(original); err == nil {
+			t.Errorf("Tag(%s) err: nil want an error", original)
+		}
+	}
+}
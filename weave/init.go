@@ -0,0 +1,155 @@
+package weave
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go/ast"
+	"sort"
+	"strconv"
+)
+
+// Init is an operation on an init function. A package has any number of them, in any of its files, so they are not
+// told apart by name. Inserts add as many init functions as the weave declares, in order, where tells when they run:
+//
+//	// +weaver insert          before the init functions of the target file
+//	// +weaver insert after    after the init functions of the target file
+//	// +weaver insert first    before every init function of the package
+//	// +weaver insert last     after every init function of the package
+//
+// A replace, replaceAndCallOriginal or delete applies to an init function of the target file given by its index, 1
+// for the first. Without one the target file must have a single init function. replaceAndCallOriginal renames it
+// initOriginal followed by the index, initOriginal2 for the second, the init of the weave can call it. No two of these
+// operations may apply to the same init function.
+//
+//	// +weaver replace 2
+//	func init() { ... }
+type Init struct {
+	w     *Weave
+	Op    string
+	Where string
+	Index int
+	Decl  *ast.FuncDecl
+	// name identifies the operation in the report: init#2 for the second init the weave inserts, init[2] for the
+	// second init of the target file
+	name string
+}
+
+// Init arguments
+const (
+	initFunc  string = "init"
+	initAfter string = "after"
+	initFirst string = "first"
+	initLast  string = "last"
+)
+
+// isInit reports whether fd is an init function
+func isInit(fd *ast.FuncDecl) bool {
+	return fd.Recv == nil && fd.Name.Name == initFunc
+}
+
+// addInit records operation op on init function fd of the weave
+func (w *Weave) addInit(op string, fd *ast.FuncDecl, args []string) {
+	in := &Init{w: w, Op: op, Decl: fd}
+	var rest []string
+	for _, a := range args {
+		i, err := strconv.Atoi(a)
+		switch {
+		case op == insert && in.Where == "" && (a == initAfter || a == initFirst || a == initLast):
+			in.Where = a
+		case op != insert && in.Index == 0 && err == nil && i > 0:
+			in.Index = i
+		default:
+			rest = append(rest, a)
+		}
+	}
+	switch op {
+	case insert:
+		n := 1
+		for _, other := range w.inits {
+			if other.Op == insert {
+				n++
+			}
+		}
+		in.name = fmt.Sprintf("%s#%d", initFunc, n)
+	case replace, delete, replaceAndCallOriginal:
+		for _, other := range w.inits {
+			if other.Op != insert && (other.Index == in.Index || other.Index == 0 || in.Index == 0) {
+				log.Fatalf("addInit: %s: %s and %s apply to the same init function, give each the index of a different one", w.filename, other.Op, op)
+			}
+		}
+		in.name = initFunc
+		if in.Index > 0 {
+			in.name = fmt.Sprintf("%s[%d]", initFunc, in.Index)
+		}
+	default:
+		log.Fatalf("addInit: %s: %s does not apply to init functions", w.filename, op)
+	}
+	w.addArgs(op, in.name, rest)
+	w.inits = append(w.inits, in)
+}
+
+// Inits lists the init operations of the weave on its target file, those of the whole package are left out, see
+// PackageInits
+func (w *Weave) Inits() (r []*Init) {
+	for _, in := range w.inits {
+		if in.Where != initFirst && in.Where != initLast {
+			r = append(r, in)
+		}
+	}
+	return
+}
+
+// PackageInits lists the init functions the selected weaves insert first, or last, of the whole package in the order
+// of the weave files and of their declarations
+func (w *Pkg) PackageInits(last bool) (r []*Init) {
+	where := initFirst
+	if last {
+		where = initLast
+	}
+	var weaves []*Weave
+	for _, ww := range w.selected {
+		if !ww.skipped {
+			weaves = append(weaves, ww)
+		}
+	}
+	sort.Slice(weaves, func(i, j int) bool { return weaves[i].filename < weaves[j].filename })
+	for _, ww := range weaves {
+		for _, in := range ww.inits {
+			if in.Where == where {
+				r = append(r, in)
+			}
+		}
+	}
+	return
+}
+
+// Imports lists the imports of the weave file
+func (w *Weave) Imports() []*ast.ImportSpec {
+	return w.file.Imports
+}
+
+// Weave is the weave the operation belongs to
+func (in *Init) Weave() *Weave {
+	return in.w
+}
+
+// Matched records that the operation found its target, an init function inserted always does
+func (in *Init) Matched() {
+	in.w.match(in.Op, in.name)
+}
+
+// OriginalName is what replaceAndCallOriginal renames the original init function, initOriginal followed by its
+// index when it has one
+func (in *Init) OriginalName() string {
+	if in.Index > 0 {
+		return fmt.Sprintf("%s%s%d", initFunc, originalSuffix, in.Index)
+	}
+	return initFunc + originalSuffix
+}
+
+// Pinned checks the original init function n a replace or delete applies to against its pinned hash, it is false
+// when upstream drifted and the operation must not be applied
+func (in *Init) Pinned(n ast.Node) bool {
+	decl := ast.Node(in.Decl)
+	return in.w.pinned(in.Op, in.name, n, &decl)
+}
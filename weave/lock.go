@@ -0,0 +1,198 @@
+package weave
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go/ast"
+	"go/printer"
+	"go/token"
+	"gweaver/diff"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Policies for a target that changed since its weave was pinned
+const (
+	DriftFail string = "fail"
+	DriftWarn string = "warn"
+)
+
+// LockEntry pins the original declaration an operation was written against
+type LockEntry struct {
+	Package  string `json:"package"`
+	File     string `json:"file"`
+	Op       string `json:"op"`
+	Name     string `json:"name"`
+	Version  string `json:"version"`
+	Hash     string `json:"hash"`
+	Original string `json:"original"`
+}
+
+// Lock is the lock file the weaver generates, it holds the original of every declaration a weave replaces or deletes
+type Lock struct {
+	filename string
+	policy   string
+	update   bool
+	changed  bool
+	Entries  []*LockEntry `json:"entries"`
+}
+
+// OpenLock reads the lock file if it exists, update re-pins drifted targets instead of applying the policy
+func OpenLock(filename string, policy string, update bool) (l *Lock) {
+	if policy != DriftFail && policy != DriftWarn {
+		log.Fatalf("OpenLock: invalid drift policy: %s", policy)
+	}
+	l = &Lock{filename: filename, policy: policy, update: update}
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		log.Infof("OpenLock: %s does not exist, it will be created", filename)
+		return
+	}
+	if err != nil {
+		log.Fatalf("OpenLock: error reading lock file: %s err: %+v", filename, err)
+	}
+	if err = json.Unmarshal(b, l); err != nil {
+		log.Fatalf("OpenLock: error parsing lock file: %s err: %+v", filename, err)
+	}
+	return
+}
+
+// Save writes the lock file if any entry was added or re-pinned
+func (l *Lock) Save() {
+	if !l.changed {
+		return
+	}
+	sort.Slice(l.Entries, func(i, j int) bool {
+		a, b := l.Entries[i], l.Entries[j]
+		if a.Package != b.Package {
+			return a.Package < b.Package
+		}
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Op != b.Op {
+			return a.Op < b.Op
+		}
+		return a.Name < b.Name
+	})
+	b, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		log.Fatalf("Lock.Save: error encoding lock file: %+v", err)
+	}
+	if err = ioutil.WriteFile(l.filename, append(b, '\n'), 0644); err != nil {
+		log.Errorf("Lock.Save: error writing lock file: %s err: %+v", l.filename, err)
+	}
+}
+
+func (l *Lock) find(pkg, file, op, name string) *LockEntry {
+	for _, e := range l.Entries {
+		if e.Package == pkg && e.File == file && e.Op == op && e.Name == name {
+			return e
+		}
+	}
+	return nil
+}
+
+func (l *Lock) pin(e *LockEntry) {
+	l.changed = true
+	if old := l.find(e.Package, e.File, e.Op, e.Name); old != nil {
+		*old = *e
+		return
+	}
+	l.Entries = append(l.Entries, e)
+}
+
+// UseLock checks, and records, the originals of the package's weave targets in l
+func (w *Pkg) UseLock(l *Lock) {
+	w.lock = l
+}
+
+// pinned compares the original target n of an operation with its pinned hash.
+// It returns false when upstream drifted and the operation must not be applied.
+func (w *Weave) pinned(op string, name string, n ast.Node, wn *ast.Node) (ok bool) {
+	key := opKey(op, name)
+	expected := w.pins[key]
+	l := w.pkg.lock
+	if l == nil && expected == "" {
+		return true
+	}
+
+	original := printNode(w.pkg.target.fset, n)
+	hash := hashOf(original)
+	var entry *LockEntry
+	if l != nil {
+		entry = l.find(w.pkg.target.path, filepath.Base(w.filename), op, name)
+	}
+	if expected == "" && entry != nil {
+		expected = entry.Hash
+	}
+	current := &LockEntry{Package: w.pkg.target.path, File: filepath.Base(w.filename), Op: op, Name: name, Version: w.pkg.target.version, Hash: hash, Original: original}
+	if expected == "" || expected == hash {
+		if l != nil && (entry == nil || entry.Hash != hash) {
+			l.pin(current)
+		}
+		return true
+	}
+
+	w.drifted[key] = true
+	var old *LockEntry
+	if entry != nil && entry.Hash == expected {
+		old = entry
+	}
+	woven := ""
+	if wn != nil && op != delete {
+		woven = string(w.Print(*wn)) + "\n"
+	}
+	fmt.Fprint(os.Stderr, w.driftReport(op, name, expected, old, current, woven))
+
+	if l != nil && l.update {
+		if w.pins[key] != "" {
+			log.Warnf("pinned: %s: %s %s is pinned by its annotation, update it to: %s", w.filename, op, name, hash)
+		}
+		l.pin(current)
+		return true
+	}
+	if l != nil && l.policy == DriftWarn {
+		return true
+	}
+	log.Errorf("pinned: %s: %s %s refused, upstream changed since it was pinned", w.filename, op, name)
+	return false
+}
+
+// driftReport shows the three versions of a drifted target: the pinned original, the current original and the weave
+func (w *Weave) driftReport(op, name, expected string, old *LockEntry, current *LockEntry, woven string) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "drift: %s: %s: %s %s: pinned %s now %s\n", current.Package, w.filename, op, name, expected, current.Hash)
+	currentName := "original@" + current.Version
+	if old == nil {
+		b.WriteString("the pinned original is not in the lock file, showing the current original against the weave\n")
+		b.WriteString(diff.Unified(currentName, "weave", current.Original, woven))
+		return b.String()
+	}
+	oldName := "original@" + old.Version
+	b.WriteString("upstream changes:\n")
+	b.WriteString(diff.Unified(oldName, currentName, old.Original, current.Original))
+	b.WriteString("weave changes:\n")
+	b.WriteString(diff.Unified(oldName, "weave", old.Original, woven))
+	return b.String()
+}
+
+func printNode(fset *token.FileSet, n ast.Node) string {
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, n); err != nil {
+		log.Errorf("printNode: error printing node: %+v", err)
+	}
+	buf.WriteString("\n")
+	return buf.String()
+}
+
+func hashOf(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hashPrefix + hex.EncodeToString(sum[:])
+}
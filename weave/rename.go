@@ -0,0 +1,79 @@
+package weave
+
+import (
+	log "github.com/sirupsen/logrus"
+	"go/ast"
+	"go/token"
+	"strings"
+)
+
+// Rename gives a function, method, type, variable or constant of the target package a new name and updates every
+// reference to it in the package. The weave declares it under its current name, only the name matters:
+//
+//	// +weaver rename Dial alias
+//	func dial()
+//
+// With alias the old name is kept as a forwarding wrapper, a type alias or a constant, variables cannot be forwarded.
+type Rename struct {
+	w *Weave
+	// Name is the current name, methods are written (*T).M or T.M, see FuncName
+	Name  string
+	To    string
+	Alias bool
+}
+
+// Rename arguments
+const (
+	renameOp    string = "rename"
+	renameAlias string = "alias"
+)
+
+// addRename records the rename operation of the declaration called name
+func (w *Weave) addRename(name string, args []string) {
+	if len(args) == 0 || len(args) > 2 || !token.IsIdentifier(args[0]) || (len(args) == 2 && args[1] != renameAlias) {
+		log.Fatalf("addRename: %s: %s: invalid arguments: %s, expected: NewName [alias]", w.filename, name, strings.Join(args, " "))
+	}
+	w.renames = append(w.renames, &Rename{w: w, Name: name, To: args[0], Alias: len(args) == 2})
+}
+
+// FullName is the package path qualified name of the declaration renamed, see Signature.FullName
+func (r *Rename) FullName() string {
+	return r.w.pkg.fullName(r.Name)
+}
+
+// Weave is the weave the rename belongs to
+func (r *Rename) Weave() *Weave {
+	return r.w
+}
+
+// Renamed records that the declaration was renamed
+func (r *Rename) Renamed() {
+	r.w.match(renameOp, r.Name)
+}
+
+// Apply gives id, the declaration renamed or a reference to it, the new name. The other operations keep referring to
+// it by the old one.
+func (r *Rename) Apply(id *ast.Ident) {
+	if _, ok := r.w.pkg.renamed[id]; !ok {
+		r.w.pkg.renamed[id] = id.Name
+	}
+	id.Name = r.To
+}
+
+// oldName is the name of id before a rename weave changed it
+func (w *Pkg) oldName(id *ast.Ident) string {
+	if name, ok := w.renamed[id]; ok {
+		return name
+	}
+	return id.Name
+}
+
+// Renames lists the rename operations of the selected weaves, they apply to every file of the package
+func (w *Pkg) Renames() (r []*Rename) {
+	for _, ww := range w.selected {
+		if !ww.skipped {
+			r = append(r, ww.renames...)
+		}
+	}
+	return
+}
@@ -0,0 +1,113 @@
+package weave
+
+import (
+	"go/ast"
+	"path/filepath"
+	"sort"
+)
+
+// Status values for an operation in the weave report
+const (
+	Applied   string = "applied"
+	Unmatched string = "unmatched"
+	Ambiguous string = "ambiguous"
+	Drifted   string = "drifted"
+	Skipped   string = "skipped"
+)
+
+// OpReport is the outcome of a single weave operation, it is serialized as part of the JSON report
+type OpReport struct {
+	File    string `json:"file"`
+	Op      string `json:"op"`
+	Name    string `json:"name"`
+	Matches int    `json:"matches"`
+	Status  string `json:"status"`
+}
+
+func opKey(op string, name string) string {
+	return op + separator + name
+}
+
+func (w *Weave) match(op string, name string) {
+	w.matches[opKey(op, name)]++
+}
+
+// Report lists every operation of the weave with the number of times it found its target
+func (w *Weave) Report() (r []OpReport) {
+	add := func(op string, name string) {
+		o := OpReport{File: filepath.Base(w.filename), Op: op, Name: name, Matches: w.matches[opKey(op, name)]}
+		switch {
+		case w.skipped:
+			o.Status = Skipped
+		case w.drifted[opKey(op, name)]:
+			o.Status = Drifted
+		case o.Matches == 0:
+			o.Status = Unmatched
+		case o.Matches > 1 && op != callSite && op != substitute && op != ruleOp:
+			o.Status = Ambiguous
+		default:
+			o.Status = Applied
+		}
+		r = append(r, o)
+	}
+	for _, m := range []struct {
+		op    string
+		nodes map[string]*ast.Node
+	}{{insert, w.inserts}, {delete, w.deletes}, {replace, w.replaces}, {replaceAndCallOriginal, w.replaceAndCallOriginals}} {
+		for name := range m.nodes {
+			add(m.op, name)
+		}
+	}
+	for _, i := range w.ImportAdds {
+		add(insert, i.Path.Value)
+	}
+	for _, i := range w.ImportDeletes {
+		add(delete, i.Path.Value)
+	}
+	for _, cs := range w.callSites {
+		add(callSite, cs.Target)
+	}
+	for _, s := range w.substitutes {
+		add(substitute, s.Target)
+	}
+	for _, r := range w.rules {
+		add(ruleOp, r.Name)
+	}
+	for _, s := range w.signatures {
+		add(signatureOp, s.Name)
+	}
+	for _, rn := range w.renames {
+		add(renameOp, rn.Name)
+	}
+	for _, e := range w.exposes {
+		add(exposeOp, e.Name)
+	}
+	for _, in := range w.inits {
+		add(in.Op, in.name)
+	}
+	for _, ops := range w.fields {
+		for _, fo := range ops {
+			add(fo.Op, fo.name())
+		}
+	}
+	return
+}
+
+// Report collects the operation reports of all the package's weaves in a stable order
+func (w *Pkg) Report() (r []OpReport) {
+	for _, variants := range w.weaves {
+		for _, ww := range variants {
+			r = append(r, ww.Report()...)
+		}
+	}
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].File != r[j].File {
+			return r[i].File < r[j].File
+		}
+		if r[i].Op != r[j].Op {
+			return r[i].Op < r[j].Op
+		}
+		return r[i].Name < r[j].Name
+	})
+	return
+}
@@ -0,0 +1,127 @@
+package weave
+
+import (
+	log "github.com/sirupsen/logrus"
+	"go/ast"
+	"strings"
+)
+
+// Rule rewrites code matching a pattern inside the functions of the target file, like gofmt -r. It is written as a
+// function of the weave whose parameters are typed wildcards and whose body holds the before and after patterns:
+//
+//	// +weaver rule in NewClient, (*Client).Do
+//	func timeout(d time.Duration) {
+//	before:
+//		http.Client{Timeout: d}
+//	after:
+//		http.Client{Timeout: 2 * d}
+//	}
+//
+// A single expression before and after rewrites expressions, anything else rewrites sequences of statements and an
+// empty after deletes them. A wildcard matches any expression of its type, interface{} or any matches every
+// expression, and a variadic one the remaining arguments of a call. Without in the rule applies to every function.
+type Rule struct {
+	w    *Weave
+	Name string
+	// In lists the functions the rule applies to, methods are written (*T).M or T.M
+	In            []string
+	Before, After []ast.Stmt
+	Wildcards     map[string]Wildcard
+}
+
+// Wildcard is a parameter of a rule
+type Wildcard struct {
+	Type     string
+	Variadic bool
+}
+
+// Rule labels
+const (
+	ruleOp     string = "rule"
+	ruleBefore string = "before"
+	ruleAfter  string = "after"
+	ruleIn     string = "in"
+)
+
+// addRule records rule function fd
+func (w *Weave) addRule(fd *ast.FuncDecl, args []string) {
+	r := &Rule{w: w, Name: fd.Name.Name, Wildcards: make(map[string]Wildcard)}
+	if len(args) > 0 {
+		if args[0] != ruleIn || len(args) == 1 {
+			log.Fatalf("addRule: %s: %s: invalid arguments: %s, expected: in function, ...", w.filename, r.Name, strings.Join(args, " "))
+		}
+		for _, name := range strings.Split(strings.Join(args[1:], ""), ",") {
+			if name != "" {
+				r.In = append(r.In, name)
+			}
+		}
+	}
+	for _, f := range fd.Type.Params.List {
+		wc := Wildcard{}
+		t := f.Type
+		if e, ok := t.(*ast.Ellipsis); ok {
+			wc.Variadic, t = true, e.Elt
+		}
+		wc.Type = string(w.Print(t))
+		for _, n := range f.Names {
+			r.Wildcards[n.Name] = wc
+		}
+	}
+	if fd.Body == nil {
+		log.Fatalf("addRule: %s: %s has no body", w.filename, r.Name)
+	}
+	section := ""
+	for _, s := range fd.Body.List {
+		if ls, ok := s.(*ast.LabeledStmt); ok && (ls.Label.Name == ruleBefore || ls.Label.Name == ruleAfter) {
+			section, s = ls.Label.Name, ls.Stmt
+		}
+		if _, ok := s.(*ast.EmptyStmt); ok {
+			continue
+		}
+		switch section {
+		case ruleBefore:
+			r.Before = append(r.Before, s)
+		case ruleAfter:
+			r.After = append(r.After, s)
+		default:
+			log.Fatalf("addRule: %s: %s: statement outside of the before: and after: sections", w.filename, r.Name)
+		}
+	}
+	if len(r.Before) == 0 {
+		log.Fatalf("addRule: %s: %s has no before: pattern", w.filename, r.Name)
+	}
+	w.rules = append(w.rules, r)
+}
+
+// Expression reports whether the rule rewrites an expression rather than statements
+func (r *Rule) Expression() bool {
+	if len(r.Before) != 1 || len(r.After) != 1 {
+		return false
+	}
+	_, before := r.Before[0].(*ast.ExprStmt)
+	_, after := r.After[0].(*ast.ExprStmt)
+	return before && after
+}
+
+// Applies reports whether the rule applies to function name, see In
+func (r *Rule) Applies(name string) bool {
+	if len(r.In) == 0 {
+		return true
+	}
+	for _, n := range r.In {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Rewritten records that code matching the rule was rewritten
+func (r *Rule) Rewritten() {
+	r.w.match(ruleOp, r.Name)
+}
+
+// Rules lists the rules of the weave
+func (w *Weave) Rules() []*Rule {
+	return w.rules
+}
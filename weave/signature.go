@@ -0,0 +1,230 @@
+package weave
+
+import (
+	log "github.com/sirupsen/logrus"
+	"go/ast"
+	"go/token"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Signature changes the parameters of a function or method of the target package and rewrites its calls to match.
+// The weave function declares the new parameters, they are matched to the original ones by name so parameters can
+// be added, removed and reordered. Its body assigns the default the calls pass for each parameter it adds:
+//
+//	// +weaver signature main
+//	func (c *Client) Do(ctx context.Context, req *Request) (*Response, error) {
+//		ctx = context.Background()
+//	}
+//
+// The calls of the target package are rewritten, with main those of the packages of the main module too.
+type Signature struct {
+	w *Weave
+	// Name is the function, methods are written (*T).M or T.M, see FuncName
+	Name   string
+	Params *ast.FieldList
+	// Defaults holds the expressions passed for the parameters the signature adds
+	Defaults map[string]ast.Expr
+	Main     bool
+	// original holds the parameter names of the declaration before the change, see Changed
+	original []string
+	variadic bool
+	changed  bool
+}
+
+// Signature arguments
+const (
+	signatureOp   string = "signature"
+	signatureMain string = "main"
+)
+
+// addSignature records the signature operation of weave function fd
+func (w *Weave) addSignature(fd *ast.FuncDecl, args []string) {
+	s := &Signature{w: w, Name: FuncName(fd), Params: fd.Type.Params, Defaults: make(map[string]ast.Expr)}
+	for _, a := range args {
+		switch {
+		case a == signatureMain:
+			s.Main = true
+		default:
+			log.Warnf("addSignature: %s: unknown argument: %s for: %s %s", w.filename, a, signatureOp, s.Name)
+		}
+	}
+	params := make(map[string]bool)
+	for _, n := range s.ParamNames() {
+		params[n] = true
+	}
+	if fd.Body != nil {
+		for _, st := range fd.Body.List {
+			as, ok := st.(*ast.AssignStmt)
+			if !ok || as.Tok != token.ASSIGN || len(as.Lhs) != 1 || len(as.Rhs) != 1 {
+				log.Fatalf("addSignature: %s: %s: only assignments of parameter defaults may be in its body", w.filename, s.Name)
+			}
+			id, ok := as.Lhs[0].(*ast.Ident)
+			if !ok || !params[id.Name] {
+				log.Fatalf("addSignature: %s: %s: a default is assigned to: %s which is not one of its parameters", w.filename, s.Name, w.Print(as.Lhs[0]))
+			}
+			s.Defaults[id.Name] = as.Rhs[0]
+		}
+	}
+	w.signatures = append(w.signatures, s)
+}
+
+// FuncName is the name of a function, for methods it is qualified by the receiver type: (*T).M or T.M
+func FuncName(fd *ast.FuncDecl) string {
+	return funcName(fd, func(id *ast.Ident) string { return id.Name })
+}
+
+// TargetName is the FuncName the operations refer to a function of the target package by, with the names it had
+// before a rename weave changed them
+func (w *Weave) TargetName(fd *ast.FuncDecl) string {
+	return funcName(fd, w.pkg.oldName)
+}
+
+// funcName spells FuncName with the identifiers named by name
+func funcName(fd *ast.FuncDecl, name func(id *ast.Ident) string) string {
+	if fd.Recv == nil || len(fd.Recv.List) == 0 {
+		return name(fd.Name)
+	}
+	t, star := fd.Recv.List[0].Type, false
+	if s, ok := t.(*ast.StarExpr); ok {
+		t, star = s.X, true
+	}
+	switch tt := t.(type) {
+	case *ast.IndexExpr:
+		t = tt.X
+	case *ast.IndexListExpr:
+		t = tt.X
+	}
+	id, ok := t.(*ast.Ident)
+	if !ok {
+		return name(fd.Name)
+	}
+	if star {
+		return "(*" + name(id) + ")." + name(fd.Name)
+	}
+	return name(id) + "." + name(fd.Name)
+}
+
+// FullName is the package path qualified name of the function, as types.Func.FullName spells it
+func (s *Signature) FullName() string {
+	return s.w.pkg.fullName(s.Name)
+}
+
+// fullName qualifies name, of a package level declaration or a method written (*T).M or T.M, with the path of the
+// target package the way types.Func.FullName does
+func (w *Pkg) fullName(name string) string {
+	p := w.target.path
+	switch {
+	case strings.HasPrefix(name, "(*"):
+		return "(*" + p + "." + strings.TrimPrefix(name, "(*")
+	case strings.Contains(name, "."):
+		i := strings.Index(name, ".")
+		return "(" + p + "." + name[:i] + ")" + name[i:]
+	}
+	return p + "." + name
+}
+
+// Path is the import path of the package declaring the function
+func (s *Signature) Path() string {
+	return s.w.pkg.target.path
+}
+
+// ParamNames lists the names of the new parameters in order
+func (s *Signature) ParamNames() (names []string) {
+	for _, f := range s.Params.List {
+		for _, n := range f.Names {
+			names = append(names, n.Name)
+		}
+	}
+	return
+}
+
+// ParamType is the type of new parameter name, nil if there is none
+func (s *Signature) ParamType(name string) ast.Expr {
+	for _, f := range s.Params.List {
+		for _, n := range f.Names {
+			if n.Name == name {
+				return f.Type
+			}
+		}
+	}
+	return nil
+}
+
+// Variadic reports whether the last new parameter is variadic
+func (s *Signature) Variadic() bool {
+	if len(s.Params.List) == 0 {
+		return false
+	}
+	_, ok := s.Params.List[len(s.Params.List)-1].Type.(*ast.Ellipsis)
+	return ok
+}
+
+// ImportPath is the path of the package a default refers to by name, as the weave imports it
+func (s *Signature) ImportPath(name string) (string, bool) {
+	for _, is := range s.w.file.Imports {
+		p, err := strconv.Unquote(is.Path.Value)
+		if err != nil {
+			continue
+		}
+		// Package names are assumed to be the last element of unnamed imports
+		if (is.Name != nil && is.Name.Name == name) || (is.Name == nil && path.Base(p) == name) {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// Weave is the weave the signature change belongs to
+func (s *Signature) Weave() *Weave {
+	return s.w
+}
+
+// Changed records that the declaration of the function now has the new parameters instead of original
+func (s *Signature) Changed(original []string, variadic bool) {
+	s.w.match(signatureOp, s.Name)
+	s.original, s.variadic, s.changed = original, variadic, true
+}
+
+// Original returns the parameter names the function had before the change, ok is false until it was changed. The
+// packages depending on the target may only see the function with its new signature.
+func (s *Signature) Original() (names []string, variadic bool, ok bool) {
+	return s.original, s.variadic, s.changed
+}
+
+// Signatures lists the signature operations of the selected weaves and those of other packages whose calls are
+// rewritten here, see AddCallers. They apply to every file of the package.
+func (w *Pkg) Signatures() (r []*Signature) {
+	for _, ww := range w.selected {
+		if !ww.skipped {
+			r = append(r, ww.signatures...)
+		}
+	}
+	return append(r, w.callers...)
+}
+
+// MainSignatures lists the signature operations of the selected weaves whose calls in the main module are rewritten
+func (w *Pkg) MainSignatures() (r []*Signature) {
+	for _, ww := range w.selected {
+		if ww.skipped {
+			continue
+		}
+		for _, s := range ww.signatures {
+			if s.Main {
+				r = append(r, s)
+			}
+		}
+	}
+	return
+}
+
+// AddCallers makes the package rewrite its calls of the functions of other packages whose signatures change
+func (w *Pkg) AddCallers(sigs []*Signature) {
+	w.callers = append(w.callers, sigs...)
+}
+
+// Empty reports whether the package has no weaves of its own
+func (w *Pkg) Empty() bool {
+	return len(w.weaves) == 0
+}
@@ -0,0 +1,70 @@
+package weave
+
+import (
+	log "github.com/sirupsen/logrus"
+	"go/ast"
+	"strings"
+)
+
+// Substitute swaps a type for a compatible one wherever the target package uses it: field, variable and parameter
+// types, composite literals, conversions. The replacement is either a type of the weave, woven into its target file,
+// or a type of another package:
+//
+//	// +weaver substitute sync.Mutex
+//	type tracedMutex = trace.Mutex
+//
+//	// +weaver substitute net/http.Client example.com/record.Client
+type Substitute struct {
+	w *Weave
+	// Target is the package path qualified name of the type that is swapped, e.g. net/http.Client
+	Target string
+	// Path is the import path of the replacement, empty when the replacement is woven into the package
+	Path string
+	Type string
+	// decl is the declaration of the replacement in the weave
+	decl ast.Node
+}
+
+// addSubstitute records a substitute operation. On a type of the weave the single argument is the target and the
+// type, inserted like any other, is the replacement. As a file annotation the arguments are the target and the
+// replacement's full name.
+func (w *Weave) addSubstitute(args []string, name string, n *ast.Node) {
+	s := &Substitute{w: w}
+	switch {
+	case n != nil && len(args) == 1:
+		s.Target, s.Type, s.decl = args[0], name, *n
+		w.inserts[name] = n
+	case n == nil && len(args) == 2:
+		var ok bool
+		s.Target = args[0]
+		if s.Path, s.Type, ok = splitFullName(args[1]); !ok {
+			log.Fatalf("addSubstitute: %s: invalid replacement, expected a package path and type: %s", w.filename, args[1])
+		}
+	default:
+		log.Fatalf("addSubstitute: %s: invalid substitute annotation: %s", w.filename, strings.Join(args, " "))
+	}
+	if _, _, ok := splitFullName(s.Target); !ok {
+		log.Fatalf("addSubstitute: %s: invalid target, expected a package path and type: %s", w.filename, s.Target)
+	}
+	w.substitutes = append(w.substitutes, s)
+}
+
+// Weave is the weave the substitution belongs to
+func (s *Substitute) Weave() *Weave {
+	return s.w
+}
+
+// Substituted records that a use of the target type now refers to the replacement
+func (s *Substitute) Substituted() {
+	s.w.match(substitute, s.Target)
+}
+
+// Substitutes lists the substitute operations of the selected weaves, they apply to every file of the package
+func (w *Pkg) Substitutes() (r []*Substitute) {
+	for _, ww := range w.selected {
+		if !ww.skipped {
+			r = append(r, ww.substitutes...)
+		}
+	}
+	return
+}
@@ -0,0 +1,127 @@
+package weave
+
+import (
+	"fmt"
+	"golang.org/x/mod/semver"
+	"strconv"
+	"strings"
+)
+
+// canonical parses a semantic version, see https://semver.org, into the canonical form of golang.org/x/mod/semver.
+// A leading v is optional, missing minor or patch numbers are zero and build metadata is ignored.
+func canonical(s string) (string, error) {
+	v := s
+	if !strings.HasPrefix(v, "v") {
+		v = "v" + v
+	}
+	if !semver.IsValid(v) {
+		return "", fmt.Errorf("invalid version: %s", s)
+	}
+	return semver.Canonical(v), nil
+}
+
+type comparator struct {
+	op string
+	v  string
+}
+
+func (c comparator) check(v string) bool {
+	r := semver.Compare(v, c.v)
+	switch c.op {
+	case "=":
+		return r == 0
+	case "!=":
+		return r != 0
+	case ">":
+		return r > 0
+	case ">=":
+		return r >= 0
+	case "<":
+		return r < 0
+	case "<=":
+		return r <= 0
+	}
+	return false
+}
+
+// Constraint is a set of version ranges, a version satisfies it when it satisfies any of the ranges.
+// A range is a list of comparators that must all hold, e.g. `>=v1.2.0 <v1.4.0 || ^v2.1.0`
+// Supported comparators are =, !=, >, >=, <, <=, ~ (same minor version) and ^ (same major version).
+type Constraint struct {
+	text   string
+	ranges [][]comparator
+}
+
+// ParseConstraint parses the constraint text of a `// +weaver version` annotation
+func ParseConstraint(s string) (c *Constraint, err error) {
+	c = &Constraint{text: strings.TrimSpace(s)}
+	for _, r := range strings.Split(s, "||") {
+		var cmps []comparator
+		for _, f := range strings.FieldsFunc(r, func(r rune) bool { return r == ' ' || r == ',' }) {
+			cc, err := parseComparator(f)
+			if err != nil {
+				return nil, err
+			}
+			cmps = append(cmps, cc...)
+		}
+		if len(cmps) == 0 {
+			return nil, fmt.Errorf("empty version range in: %s", s)
+		}
+		c.ranges = append(c.ranges, cmps)
+	}
+	return
+}
+
+func parseComparator(s string) (c []comparator, err error) {
+	op := ""
+	for _, o := range []string{">=", "<=", "!=", ">", "<", "=", "~", "^"} {
+		if strings.HasPrefix(s, o) {
+			op = o
+			break
+		}
+	}
+	v, err := canonical(strings.TrimPrefix(s, op))
+	if err != nil {
+		return nil, err
+	}
+	major, _ := strconv.Atoi(strings.TrimPrefix(semver.Major(v), "v"))
+	minor, _ := strconv.Atoi(strings.TrimPrefix(semver.MajorMinor(v), semver.Major(v)+"."))
+	switch op {
+	case "":
+		return []comparator{{"=", v}}, nil
+	case "~":
+		return []comparator{{">=", v}, {"<", fmt.Sprintf("v%d.%d.0", major, minor+1)}}, nil
+	case "^":
+		upper := fmt.Sprintf("v%d.0.0", major+1)
+		if major == 0 {
+			upper = fmt.Sprintf("v0.%d.0", minor+1)
+		}
+		return []comparator{{">=", v}, {"<", upper}}, nil
+	}
+	return []comparator{{op, v}}, nil
+}
+
+// Check reports whether version satisfies the constraint, versions that do not parse never do
+func (c *Constraint) Check(version string) bool {
+	v, err := canonical(version)
+	if err != nil {
+		return false
+	}
+	for _, r := range c.ranges {
+		ok := true
+		for _, cmp := range r {
+			if !cmp.check(v) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Constraint) String() string {
+	return c.text
+}
@@ -0,0 +1,54 @@
+package weave
+
+import "testing"
+
+func TestConstraint(t *testing.T) {
+	tests := []struct {
+		constraint string
+		version    string
+		want       bool
+	}{
+		{"v1.2.3", "v1.2.3", true},
+		{"1.2.3", "v1.2.3", true},
+		{"=v1.2", "v1.2.0", true},
+		{"v1.2.3", "v1.2.4", false},
+		{"!=v1.2.3", "v1.2.4", true},
+		{">=v1.2.0 <v1.4.0", "v1.3.9", true},
+		{">=v1.2.0 <v1.4.0", "v1.4.0", false},
+		{">=v1.2.0, <v1.4.0", "v1.1.9", false},
+		{">v1.2.0", "v1.2.0", false},
+		{"<=v1.2.0", "v1.2.0", true},
+		{"<v1.2.0", "v1.2.0-rc.1", true},
+		{"~v1.2.3", "v1.2.9", true},
+		{"~v1.2.3", "v1.3.0", false},
+		{"~v1.2.3", "v1.2.2", false},
+		{"^v1.2.3", "v1.9.0", true},
+		{"^v1.2.3", "v2.0.0", false},
+		{"^v0.2.3", "v0.2.9", true},
+		{"^v0.2.3", "v0.3.0", false},
+		{"<v1.0.0 || ^v2.1.0", "v0.9.0", true},
+		{"<v1.0.0 || ^v2.1.0", "v1.5.0", false},
+		{"<v1.0.0 || ^v2.1.0", "v2.3.0", true},
+		{">=v1.0.0", "v1.0.0+incompatible", true},
+		{">=v1.0.0", "not-a-version", false},
+		{">=v1.0.0", "", false},
+	}
+	for _, tt := range tests {
+		c, err := ParseConstraint(tt.constraint)
+		if err != nil {
+			t.Errorf("ParseConstraint(%q) err: %v", tt.constraint, err)
+			continue
+		}
+		if got := c.Check(tt.version); got != tt.want {
+			t.Errorf("%q.Check(%q) = %t want: %t", tt.constraint, tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestParseConstraintErrors(t *testing.T) {
+	for _, s := range []string{"", ">=", "v1.x", ">=v1.0.0 ||", "~"} {
+		if _, err := ParseConstraint(s); err == nil {
+			t.Errorf("ParseConstraint(%q) err: nil want an error", s)
+		}
+	}
+}
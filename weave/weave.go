@@ -1,27 +1,75 @@
 package weave
 
 import (
+	"bytes"
 	log "github.com/sirupsen/logrus"
 	"go/ast"
+	"go/build/constraint"
 	"go/parser"
+	"go/printer"
 	"go/token"
 	"path/filepath"
-	"regexp"
+	"sort"
 	"strings"
 )
 
 type Pkg struct {
-	weaves map[string]*Weave
+	// weaves holds the variants of the weave for each target file
+	weaves   map[string][]*Weave
+	selected map[string]*Weave
+	// outOfRange lists the target files none of whose variants accept the target version
+	outOfRange []string
+	lock       *Lock
+	target     target
+	// callers holds the signature changes of other packages whose calls in this one are rewritten
+	callers []*Signature
+	// renamed maps the identifiers rename weaves changed to their old names, the other operations refer to those
+	renamed map[*ast.Ident]string
+}
+
+// target describes the package the weaves are currently applied to
+type target struct {
+	path    string
+	fset    *token.FileSet
+	version string
 }
 
 type Weave struct {
-	file                    *ast.File
+	pkg      *Pkg
+	filename string
+	// target is the base name of the file the weave applies to, it defaults to the weave's own base name
+	target     string
+	constraint *Constraint
+	// build is the weave's own //go:build constraint, nil when it has none
+	build   constraint.Expr
+	skipped bool
+	fset    *token.FileSet
+	file    *ast.File
+	// cmap carries the weave's comments along with its nodes, positions only make sense in fset
+	cmap                    ast.CommentMap
+	nodes                   map[ast.Node]bool
 	inserts                 map[string]*ast.Node
 	deletes                 map[string]*ast.Node
 	replaces                map[string]*ast.Node
 	replaceAndCallOriginals map[string]*ast.Node
 	ImportAdds              []*ast.ImportSpec
 	ImportDeletes           []*ast.ImportSpec
+	callSites               []*CallSite
+	substitutes             []*Substitute
+	rules                   []*Rule
+	signatures              []*Signature
+	renames                 []*Rename
+	exposes                 []*Expose
+	inits                   []*Init
+	// fields holds the field operations on each struct, keyed by the struct's name
+	fields map[string][]*FieldOp
+	// stubs holds the interfaces whose implementers get stubs for the methods added, see FieldOp
+	stubs map[string]bool
+	// matches counts how often each operation found its target, keyed by opKey
+	matches map[string]int
+	// pins holds the original declaration hashes given as annotation arguments, keyed by opKey
+	pins    map[string]string
+	drifted map[string]bool
 }
 
 // Warning: I always compare to lowerCase so ensure the constants are lower case
@@ -31,20 +79,69 @@ const (
 	replace                string = "replace"
 	replaceAndCallOriginal string = "replaceandcalloriginal"
 	nop                    string = "nop"
+	version                string = "version"
+	targetFile             string = "target"
 	weaverSuffix           string = "+weaver"
 	packageFQN             string = "packagefqn"
+	callSite               string = "callsite"
+	substitute             string = "substitute"
 	separator              string = " "
 	originalSuffix         string = "Original"
+	hashPrefix             string = "sha256:"
 )
 
 func New(files []string) (w *Pkg) {
-	w = &Pkg{weaves: make(map[string]*Weave)}
+	w = &Pkg{weaves: make(map[string][]*Weave), selected: make(map[string]*Weave), renamed: make(map[*ast.Ident]string)}
 	for _, file := range files {
-		w.weaves[filepath.Base(file)] = new(file)
+		ww := new(file)
+		ww.pkg = w
+		w.weaves[ww.target] = append(w.weaves[ww.target], ww)
 	}
 	return
 }
 
+// SelectVersion picks, for each target file, the weave variant whose version constraint versionOk accepts.
+// Variants that are not picked are skipped.
+func (w *Pkg) SelectVersion(versionOk func(c *Constraint) bool) {
+	w.selected = make(map[string]*Weave)
+	w.outOfRange = nil
+	for file, variants := range w.weaves {
+		for _, ww := range variants {
+			ww.skipped = true
+			if !versionOk(ww.constraint) {
+				log.Infof("SelectVersion: %s: skipped, version %s does not satisfy: %s", ww.filename, w.target.version, ww.constraint)
+				continue
+			}
+			if s, ok := w.selected[file]; ok {
+				log.Warnf("SelectVersion: %s: skipped, %s already applies to: %s", ww.filename, s.filename, file)
+				continue
+			}
+			ww.skipped = false
+			w.selected[file] = ww
+		}
+		if _, ok := w.selected[file]; !ok {
+			log.Warnf("SelectVersion: %s: no weave variant accepts version: %s", file, w.target.version)
+			w.outOfRange = append(w.outOfRange, file)
+		}
+	}
+	sort.Strings(w.outOfRange)
+}
+
+// HasTestWeaves reports whether any weave targets a _test.go file, the package's tests then have to be loaded
+func (w *Pkg) HasTestWeaves() bool {
+	for file := range w.weaves {
+		if strings.HasSuffix(file, "_test.go") {
+			return true
+		}
+	}
+	return false
+}
+
+// OutOfRange returns the target files that have weaves but none for the target version
+func (w *Pkg) OutOfRange() []string {
+	return w.outOfRange
+}
+
 func new(filename string) (w *Weave) {
 	fset := token.NewFileSet()
 	f, err := parser.ParseFile(fset, filename, nil, parser.ParseComments)
@@ -57,7 +154,16 @@ func new(filename string) (w *Weave) {
 		log.Tracef("%+v\n", c.Text())
 	}
 
-	w = &Weave{file: f, inserts: make(map[string]*ast.Node), deletes: make(map[string]*ast.Node), replaces: make(map[string]*ast.Node), replaceAndCallOriginals: make(map[string]*ast.Node)}
+	w = &Weave{filename: filename, target: filepath.Base(filename), fset: fset, file: f, inserts: make(map[string]*ast.Node), deletes: make(map[string]*ast.Node), replaces: make(map[string]*ast.Node), replaceAndCallOriginals: make(map[string]*ast.Node), fields: make(map[string][]*FieldOp), stubs: make(map[string]bool), matches: make(map[string]int), pins: make(map[string]string), drifted: make(map[string]bool)}
+
+	w.parseBuildConstraint()
+
+	// File level annotations apply to the whole weave wherever they are
+	for _, cg := range f.Comments {
+		for _, c := range cg.List {
+			w.parseFileAnnotation(c)
+		}
+	}
 
 	// walk the tree once capturing the Weave nodes
 	ast.Inspect(f, func(n ast.Node) bool {
@@ -66,23 +172,54 @@ func new(filename string) (w *Weave) {
 		case *ast.FuncDecl:
 			log.Tracef("Inspect: type: %T value: %+v", t, t)
 			//spew.Dump(t)
-			op := w.parseCommentGroup(t.Doc)
+			op, args := w.parseCommentGroup(t.Doc)
 			if op == nop {
 				break
 			}
-			if op == replace {
-				op = w.replaceOriginal(t, &n)
+			if op == callSite {
+				w.addCallSite(args, t, &n)
+				break
+			}
+			if op == ruleOp {
+				w.addRule(t, args)
+				break
+			}
+			if op == signatureOp {
+				w.addSignature(t, args)
+				break
+			}
+			if op == renameOp {
+				w.addRename(FuncName(t), args)
+				break
+			}
+			if isInit(t) {
+				w.addInit(op, t, args)
+				break
 			}
 			w.addNode(op, t.Name.Name, &n)
+			w.addArgs(op, t.Name.Name, args)
 
 			// GenDecl covers const, import, type, and var with Doc (block) comments
 		case *ast.GenDecl:
 			log.Tracef("Inspect: type: %T value: %+v", t, t)
-			op := w.parseCommentGroup(t.Doc)
+			op, args := w.parseCommentGroup(t.Doc)
 			if op == nop {
 				break
 			}
 			name := getGenDeclName(t)
+			if op == substitute {
+				w.addSubstitute(args, name, &n)
+				break
+			}
+			if op == renameOp {
+				w.addRename(name, args)
+				break
+			}
+			if ts, ok := t.Specs[0].(*ast.TypeSpec); ok && (op == structFields || op == interfaceMethods) {
+				w.addFields(ts, op, args)
+				break
+			}
+			w.addArgs(op, name, args)
 			switch d := t.Specs[0].(type) {
 			case *ast.ImportSpec:
 				w.processImportSpec(&n, d, op, name)
@@ -96,25 +233,27 @@ func new(filename string) (w *Weave) {
 			// These 3 cases cover const, import, type, and  var with line comments
 		case *ast.ImportSpec:
 			log.Tracef("Inspect: type: %T value: %+v", t, t)
-			op := w.parseCommentGroup(t.Comment)
+			op, _ := w.parseCommentGroup(t.Comment)
 			if op == nop {
 				break
 			}
 			w.addImport(op, t)
 		case *ast.TypeSpec:
 			log.Tracef("Inspect: type: %T value: %+v", t, t)
-			op := w.parseCommentGroup(t.Comment)
+			op, args := w.parseCommentGroup(t.Comment)
 			if op == nop {
 				break
 			}
 			w.addNode(op, t.Name.Name, &n)
+			w.addArgs(op, t.Name.Name, args)
 		case *ast.ValueSpec: // const is also a value spec
 			log.Tracef("Inspect: type: %T value: %+v", t, t)
-			op := w.parseCommentGroup(t.Comment)
+			op, args := w.parseCommentGroup(t.Comment)
 			if op == nop {
 				break
 			}
 			w.addNode(op, valueSpecName(t.Names), &n)
+			w.addArgs(op, valueSpecName(t.Names), args)
 		case *ast.CommentGroup:
 			log.Tracef("Inspect: type: %T value: %+v", t, t)
 			w.parseCommentGroup(t)
@@ -127,27 +266,18 @@ func new(filename string) (w *Weave) {
 		return true
 	})
 
-	log.Tracef("Parsed Weave:\n %+v \n", w)
-	return
-}
-
-func (w *Weave) replaceOriginal(decl *ast.FuncDecl, node *ast.Node) (op string) {
-	log.Tracef("replaceOriginal: decl: %+v node: %+v", *decl, *node)
-	op = replace
-	// rename the original
-	originalFnName := decl.Name.Name
-	decl.Name.Name = originalFnName + originalSuffix
-	op = insert
-	// walk the Weave node replacing the original calls
-	ast.Inspect(*node, func(n ast.Node) bool {
-		switch t := n.(type) {
-		case *ast.CallExpr:
-			log.Tracef("\treplaceOriginal: Inspect: type: %T value: %+v", t, t)
-		default:
-			log.Tracef("\treplaceOriginal: Inspect: type: %T value: %+v", t, t)
+	w.cmap = ast.NewCommentMap(fset, f, f.Comments)
+	w.nodes = make(map[ast.Node]bool)
+	for _, d := range f.Decls {
+		w.nodes[d] = true
+		if gd, ok := d.(*ast.GenDecl); ok {
+			for _, s := range gd.Specs {
+				w.nodes[s] = true
+			}
 		}
-		return true
-	})
+	}
+
+	log.Tracef("Parsed Weave:\n %+v \n", w)
 	return
 }
 
@@ -219,6 +349,94 @@ func (w *Weave) addNode(op string, name string, n *ast.Node) {
 	default:
 	}
 }
+
+// parseBuildConstraint reads the //go:build line, or the // +build lines, before the weave's package clause
+func (w *Weave) parseBuildConstraint() {
+	var plus constraint.Expr
+	for _, cg := range w.file.Comments {
+		if cg.Pos() >= w.file.Package {
+			break
+		}
+		for _, c := range cg.List {
+			if !constraint.IsGoBuild(c.Text) && !constraint.IsPlusBuild(c.Text) {
+				continue
+			}
+			x, err := constraint.Parse(c.Text)
+			if err != nil {
+				log.Fatalf("parseBuildConstraint: %s: invalid build constraint: %s err: %+v", w.filename, c.Text, err)
+			}
+			switch {
+			case constraint.IsGoBuild(c.Text):
+				w.build = x
+			case plus == nil:
+				plus = x
+			default:
+				plus = &constraint.AndExpr{X: plus, Y: x}
+			}
+		}
+	}
+	if w.build == nil {
+		w.build = plus
+	}
+}
+
+// BuildOk reports whether the weave's build constraint holds given which build tags are satisfied
+func (w *Weave) BuildOk(tag func(tag string) bool) bool {
+	return w.build == nil || w.build.Eval(tag)
+}
+
+// Skip leaves the weave out, its operations are reported as skipped
+func (w *Weave) Skip(reason string) {
+	log.Infof("Skip: %s: skipped, %s", w.filename, reason)
+	w.skipped = true
+}
+
+func (w *Weave) parseFileAnnotation(c *ast.Comment) {
+	op, args, ok := w.parseComment(c)
+	if !ok {
+		return
+	}
+	switch op {
+	case version:
+		cs, err := ParseConstraint(strings.Join(args, " "))
+		if err != nil {
+			log.Fatalf("parseFileAnnotation: %s: invalid version constraint: %s err: %+v", w.filename, c.Text, err)
+		}
+		w.constraint = cs
+	case targetFile:
+		if len(args) != 1 {
+			log.Fatalf("parseFileAnnotation: %s: invalid target annotation: %s", w.filename, c.Text)
+		}
+		w.target = args[0]
+		if !strings.HasSuffix(w.target, ".go") {
+			w.target += ".go"
+		}
+	case callSite:
+		// The single argument form annotates an advice function of the weave, see addCallSite
+		if len(args) == 2 {
+			w.addCallSite(args, nil, nil)
+		}
+	case substitute:
+		if len(args) == 2 {
+			w.addSubstitute(args, "", nil)
+		}
+	case exposeOp:
+		w.addExpose(args)
+	}
+}
+
+// addArgs keeps the annotation arguments an operation understands
+func (w *Weave) addArgs(op string, name string, args []string) {
+	for _, a := range args {
+		switch {
+		case strings.HasPrefix(a, hashPrefix):
+			w.pins[opKey(op, name)] = a
+		default:
+			log.Warnf("addArgs: %s: unknown argument: %s for: %s %s", w.filename, a, op, name)
+		}
+	}
+}
+
 func (w *Weave) addImport(op string, n *ast.ImportSpec) {
 	switch op {
 	case insert:
@@ -241,51 +459,57 @@ func valueSpecName(i []*ast.Ident) string {
 	return "Unknown"
 }
 
+// parseCommentGroup returns the operation annotating a declaration, the file level annotations in the group are
+// skipped, parseFileAnnotation took care of them
 // TODO genericize this to deal with more than op: function rename, debug comment, ?
-func (w *Weave) parseCommentGroup(group *ast.CommentGroup) (op string) {
+func (w *Weave) parseCommentGroup(group *ast.CommentGroup) (op string, args []string) {
 	//log.Tracef("parseCommentGroup:  group: %+v", group)
 	op = nop
 	if group == nil {
 		return
 	}
 	for _, c := range group.List {
-		op, ok := w.parseComment(c)
-		if ok {
-			return op
+		op, args, ok := w.parseComment(c)
+		if ok && !fileLevel(op, args) {
+			return op, args
 		}
 	}
-	return op
+	return op, nil
+}
+
+// fileLevel reports whether an annotation applies to the whole weave rather than to the declaration it documents
+func fileLevel(op string, args []string) bool {
+	switch op {
+	case version, targetFile, exposeOp:
+		return true
+	case callSite, substitute:
+		return len(args) == 2
+	}
+	return false
 }
 
-func (w *Weave) parseComment(c *ast.Comment) (op string, ok bool) {
+// parseComment understands `// +weaver op arg...`, the op is case insensitive, the arguments are kept as written
+func (w *Weave) parseComment(c *ast.Comment) (op string, args []string, ok bool) {
 	op = nop
 	ok = false
-	s := strings.ToLower(strings.Trim(c.Text, " "))
+	s := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(c.Text, "//"), "/*"), "*/")
 	log.Tracef("parseComment: %s", s)
-	if !strings.Contains(s, weaverSuffix) {
+	fields := strings.Fields(s)
+	i := 0
+	for i < len(fields) && strings.ToLower(fields[i]) != weaverSuffix {
+		i++
+	}
+	if i+1 >= len(fields) {
 		return
 	}
-	if strings.HasSuffix(s, insert) {
-		op = insert
-		ok = true
-	} else if strings.HasSuffix(s, delete) {
-		op = delete
-		ok = true
-	} else if strings.HasSuffix(s, replace) {
-		op = replace
+	args = fields[i+2:]
+	switch o := strings.ToLower(fields[i+1]); o {
+	case insert, delete, replace, replaceAndCallOriginal, version, targetFile, callSite, substitute, structFields, interfaceMethods, fieldType, fieldTag, ruleOp, signatureOp, renameOp, exposeOp:
+		op = o
 		ok = true
-	} else if strings.HasSuffix(s, replaceAndCallOriginal) {
-		op = replaceAndCallOriginal
-		ok = true
-	} else if strings.Contains(s, packageFQN) {
-		space := regexp.MustCompile(`\s+`)
-		s := space.ReplaceAllString(s, " ")
-		p := strings.Split(s, separator)
-		if len(p) != 4 {
-			for i, v := range p {
-				log.Tracef("parseComment: i: %d v: %s", i, v)
-			}
-			log.Fatalf("parseComment: invalid packageFQN annotation: len: %d %+v text: %s", c, s)
+	case packageFQN:
+		if len(args) != 1 {
+			log.Fatalf("parseComment: invalid packageFQN annotation: len: %d %+v text: %s", len(args), c, s)
 		}
 		op = packageFQN
 		ok = true
@@ -304,35 +528,98 @@ func (w *Pkg) has(n ast.Node) (r ast.Node, ok bool) {
 }
 
 func (w *Weave) GetReplace(n ast.Node) (r *ast.Node, ok bool) {
-	nn := nodeName(n)
+	nn := w.pkg.nodeName(n)
 	r, ok = w.replaces[nn]
-	log.Tracef("getReplace: ok: %s nn: %s", ok, nn)
+	log.Tracef("getReplace: ok: %t nn: %s", ok, nn)
+	if ok {
+		w.match(replace, nn)
+		ok = w.pinned(replace, nn, n, r)
+		w.pkg.keepName(n, *r)
+	}
 	return
 }
 
 func (w *Weave) GetReplaceAndCallOriginal(n ast.Node) (r *ast.Node, ok bool) {
-	nn := nodeName(n)
+	nn := w.pkg.nodeName(n)
 	r, ok = w.replaceAndCallOriginals[nn]
-	log.Tracef("getReplaceAndCallOriginal: ok: %s nn: %s", ok, nn)
+	log.Tracef("getReplaceAndCallOriginal: ok: %t nn: %s", ok, nn)
+	if ok {
+		w.match(replaceAndCallOriginal, nn)
+		ok = w.pinned(replaceAndCallOriginal, nn, n, r)
+		w.pkg.keepName(n, *r)
+	}
 	return
 }
 
 func (w *Weave) GetDelete(n ast.Node) (r *ast.Node, ok bool) {
-	nn := nodeName(n)
+	nn := w.pkg.nodeName(n)
 	r, ok = w.deletes[nn]
-	log.Tracef("getDelete: ok: %s nn: %s", ok, nn)
+	log.Tracef("getDelete: ok: %t nn: %s", ok, nn)
+	if ok {
+		w.match(delete, nn)
+		ok = w.pinned(delete, nn, n, r)
+	}
 	return
 }
 
+// OriginalName is what a replaceAndCallOriginal weave calls the original of n, its old name when a rename weave
+// changed it followed by Original
+func (w *Weave) OriginalName(n ast.Node) string {
+	return w.pkg.nodeName(n) + originalSuffix
+}
+
+// keepName gives the weave's replacement r of n the name n has now, the new one when a rename weave changed it
+func (w *Pkg) keepName(n ast.Node, r ast.Node) {
+	var from, to *ast.Ident
+	switch t := n.(type) {
+	case *ast.FuncDecl:
+		from = t.Name
+		if rd, ok := r.(*ast.FuncDecl); ok {
+			to = rd.Name
+		}
+	case *ast.TypeSpec:
+		from = t.Name
+		if rs, ok := r.(*ast.TypeSpec); ok {
+			to = rs.Name
+		}
+	case *ast.ValueSpec:
+		if rs, ok := r.(*ast.ValueSpec); ok && len(t.Names) == 1 && len(rs.Names) == 1 {
+			from, to = t.Names[0], rs.Names[0]
+		}
+	}
+	if from != nil && to != nil && from.Name != w.oldName(from) {
+		to.Name = from.Name
+	}
+}
+
+// SetTarget tells the weaves which package, and which version of it, they are applied to
+func (w *Pkg) SetTarget(path string, fset *token.FileSet, version string) {
+	w.target = target{path: path, fset: fset, version: version}
+}
+
+// GetInserts is only called once the insertion point has been found so every insert counts as applied
 func (w *Weave) GetInserts() map[string]*ast.Node {
+	for name := range w.inserts {
+		w.match(insert, name)
+	}
 	return w.inserts
 }
 
+// ImportAdded records that an ImportAdds entry was applied to the target file
+func (w *Weave) ImportAdded(i *ast.ImportSpec) {
+	w.match(insert, i.Path.Value)
+}
+
+// ImportDeleted records that an ImportDeletes entry was removed from the target file
+func (w *Weave) ImportDeleted(i *ast.ImportSpec) {
+	w.match(delete, i.Path.Value)
+}
+
 func (w *Pkg) GetWeaveForFile(file string) (ww *Weave) {
 	if !strings.HasSuffix(file, ".go") {
 		file = strings.TrimSpace(file) + ".go"
 	}
-	ww = w.weaves[file]
+	ww = w.selected[file]
 	log.Debugf("GetWeaveForFile: file: %s weave: %+v weaves: %+v", file, ww, w.weaves)
 	if log.IsLevelEnabled(log.DebugLevel) {
 		//spew.Dump(w.weaves)
@@ -340,18 +627,153 @@ func (w *Pkg) GetWeaveForFile(file string) (ww *Weave) {
 	return
 }
 
-func nodeName(n ast.Node) (name string) {
+// Owns reports whether n is a top-level declaration, or a spec of one, taken from the weave
+func (w *Weave) Owns(n ast.Node) bool {
+	return w.nodes[n]
+}
+
+// Print formats one of the weave's nodes using the weave's own FileSet, with its comments but the +weaver annotations
+func (w *Weave) Print(n ast.Node) []byte {
+	var comments []*ast.CommentGroup
+	for _, g := range w.cmap.Filter(n).Comments() {
+		if g = w.withoutAnnotations(g); g != nil {
+			comments = append(comments, g)
+		}
+	}
+	// Without comments of its own the printer falls back on the Doc and Comment fields, annotations included
+	if len(comments) == 0 {
+		defer stripComments(n)()
+	}
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, w.fset, &printer.CommentedNode{Node: n, Comments: comments}); err != nil {
+		log.Errorf("Print: %s: error printing node: %+v", w.filename, err)
+	}
+	return buf.Bytes()
+}
+
+// withoutAnnotations is comment group g without its +weaver annotations, nil when nothing else is left
+func (w *Weave) withoutAnnotations(g *ast.CommentGroup) *ast.CommentGroup {
+	if g == nil {
+		return nil
+	}
+	var list []*ast.Comment
+	for _, c := range g.List {
+		if _, _, ok := w.parseComment(c); !ok {
+			list = append(list, c)
+		}
+	}
+	if len(list) == 0 {
+		return nil
+	}
+	// The comments left take the places of the last ones, a doc comment stays right above its declaration
+	off := len(g.List) - len(list)
+	for i, c := range list {
+		list[i] = &ast.Comment{Slash: g.List[off+i].Slash, Text: c.Text}
+	}
+	return &ast.CommentGroup{List: list}
+}
+
+// stripComments clears the Doc and Comment fields of n and the nodes under it, it returns the function restoring them
+func stripComments(n ast.Node) (restore func()) {
+	var fields []**ast.CommentGroup
+	ast.Inspect(n, func(n ast.Node) bool {
+		switch t := n.(type) {
+		case *ast.FuncDecl:
+			fields = append(fields, &t.Doc)
+		case *ast.GenDecl:
+			fields = append(fields, &t.Doc)
+		case *ast.TypeSpec:
+			fields = append(fields, &t.Doc, &t.Comment)
+		case *ast.ValueSpec:
+			fields = append(fields, &t.Doc, &t.Comment)
+		case *ast.ImportSpec:
+			fields = append(fields, &t.Doc, &t.Comment)
+		case *ast.Field:
+			fields = append(fields, &t.Doc, &t.Comment)
+		}
+		return true
+	})
+	saved := make([]*ast.CommentGroup, len(fields))
+	for i, f := range fields {
+		saved[i], *f = *f, nil
+	}
+	return func() {
+		for i, f := range fields {
+			*f = saved[i]
+		}
+	}
+}
+
+// Filename is the path of the weave file
+func (w *Weave) Filename() string {
+	return w.filename
+}
+
+// Op returns the operation a node taken from the weave performs, empty when n is not one of the weave's operations.
+// For a declaration holding a single annotated spec the spec's operation is returned.
+func (w *Weave) Op(n ast.Node) string {
+	for _, cs := range w.callSites {
+		if cs.decl != nil && cs.decl == n {
+			return callSite
+		}
+	}
+	for _, s := range w.substitutes {
+		if s.decl != nil && s.decl == n {
+			return substitute
+		}
+	}
+	for _, in := range w.inits {
+		if in.Decl == n {
+			return in.Op
+		}
+	}
+	for _, m := range []struct {
+		op    string
+		nodes map[string]*ast.Node
+	}{{insert, w.inserts}, {replace, w.replaces}, {replaceAndCallOriginal, w.replaceAndCallOriginals}} {
+		for _, wn := range m.nodes {
+			if *wn == n {
+				return m.op
+			}
+			if gd, ok := n.(*ast.GenDecl); ok && len(gd.Specs) == 1 && *wn == gd.Specs[0] {
+				return m.op
+			}
+		}
+	}
+	return ""
+}
+
+// Position returns where a top-level declaration of the weave starts, ok is false when n is not one of them
+func (w *Weave) Position(n ast.Node) (pos token.Position, ok bool) {
+	for _, d := range w.file.Decls {
+		if d != n {
+			continue
+		}
+		pos = w.fset.Position(d.Pos())
+		if abs, err := filepath.Abs(pos.Filename); err == nil {
+			pos.Filename = abs
+		}
+		return pos, true
+	}
+	return
+}
+
+// nodeName is the name the operations refer to n by, a declaration a rename weave changed keeps its old one
+func (w *Pkg) nodeName(n ast.Node) (name string) {
 	switch t := n.(type) {
 	case *ast.FuncDecl:
-		return t.Name.Name
+		return w.oldName(t.Name)
 	//case *ast.GenDecl:
 	//	if len(t.Specs) < 1 {
 	//		return ""
 	//	}
 	//	return nodeName(t.Specs[0])
 	case *ast.TypeSpec:
-		return t.Name.Name
+		return w.oldName(t.Name)
 	case *ast.ValueSpec:
+		if len(t.Names) == 1 {
+			return w.oldName(t.Names[0])
+		}
 		return valueSpecName(t.Names)
 	case *ast.ImportSpec:
 		return t.Path.Value
@@ -0,0 +1,57 @@
+package weave
+
+import (
+	"go/ast"
+	"reflect"
+	"testing"
+)
+
+func TestParseComment(t *testing.T) {
+	tests := []struct {
+		text string
+		op   string
+		args []string
+		ok   bool
+	}{
+		{"// +weaver replace", replace, []string{}, true},
+		{"// +weaver Insert after Retries", insert, []string{"after", "Retries"}, true},
+		{"// +weaver replaceAndCallOriginal 2 sha256:abc", replaceAndCallOriginal, []string{"2", "sha256:abc"}, true},
+		{"/* +weaver delete */", delete, []string{}, true},
+		{"//+weaver delete", delete, []string{}, true},
+		{"// Dial dials. +weaver rename Connect alias", renameOp, []string{"Connect", "alias"}, true},
+		{"// +weaver rule in wait, (*T).M", ruleOp, []string{"in", "wait,", "(*T).M"}, true},
+		{"// +weaver version >=v1.2.0 <v2", version, []string{">=v1.2.0", "<v2"}, true},
+		{"// +weaver", nop, nil, false},
+		{"// +weaver unknown arg", nop, []string{"arg"}, false},
+		{"// a comment", nop, nil, false},
+	}
+	w := &Weave{filename: "test.go"}
+	for _, tt := range tests {
+		op, args, ok := w.parseComment(&ast.Comment{Text: tt.text})
+		if op != tt.op || ok != tt.ok || !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("parseComment(%q) = %s %q %t want: %s %q %t", tt.text, op, args, ok, tt.op, tt.args, tt.ok)
+		}
+	}
+
+	// The file level annotations of a doc comment do not hide the operation of its declaration
+	groups := []struct {
+		text []string
+		op   string
+	}{
+		{[]string{"// +weaver version >=v1.2", "// +weaver replace"}, replace},
+		{[]string{"// +weaver target conn.go", "// +weaver delete"}, delete},
+		{[]string{"// +weaver callsite net/http.Get example.com/trace.Get", "// +weaver replace"}, replace},
+		{[]string{"// +weaver callsite net/http.Get"}, callSite},
+		{[]string{"// +weaver expose dial", "// +weaver substitute sync.Mutex"}, substitute},
+		{[]string{"// Doc.", "// +weaver version >=v1.2"}, nop},
+	}
+	for _, tt := range groups {
+		g := &ast.CommentGroup{}
+		for _, text := range tt.text {
+			g.List = append(g.List, &ast.Comment{Text: text})
+		}
+		if op, _ := w.parseCommentGroup(g); op != tt.op {
+			t.Errorf("parseCommentGroup(%q) = %s want: %s", tt.text, op, tt.op)
+		}
+	}
+}